@@ -0,0 +1,96 @@
+package dynamic_proxy
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/jhump/protoreflect/desc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/descriptorpb"
+)
+
+// errNotConnected is returned while routes are served from the cache and the target is still being dialed.
+var errNotConnected = status.Error(codes.Unavailable, "target is not connected yet")
+
+// cachePath is the protoset file the descriptors of target are cached in.
+func cachePath(dir, target string) string {
+	return filepath.Join(dir, url.QueryEscape(target)+".protoset")
+}
+
+// saveCache writes the descriptors of table to the cache dir. The file is replaced by a rename,
+// so a crash never leaves a truncated cache behind.
+func (c *ReflectClient) saveCache(table *routeTable) error {
+	if c.opts.cacheDir == "" {
+		return nil
+	}
+	b, err := proto.MarshalOptions{Deterministic: true}.Marshal(desc.ToFileDescriptorSet(table.files...))
+	if err != nil {
+		return fmt.Errorf("failed to marshal descriptor cache: %v", err)
+	}
+	if err = os.MkdirAll(c.opts.cacheDir, 0o755); err != nil {
+		return fmt.Errorf("failed to create cache dir: %v", err)
+	}
+	path := cachePath(c.opts.cacheDir, c.target)
+	tmp, err := os.CreateTemp(c.opts.cacheDir, filepath.Base(path)+".*")
+	if err != nil {
+		return fmt.Errorf("failed to write descriptor cache: %v", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err = tmp.Write(b); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write descriptor cache: %v", err)
+	}
+	if err = tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write descriptor cache: %v", err)
+	}
+	if err = os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("failed to write descriptor cache: %v", err)
+	}
+	return nil
+}
+
+// loadCache serves the router from the cached descriptors until the target answers.
+func (c *ReflectClient) loadCache() error {
+	if c.opts.cacheDir == "" {
+		return fmt.Errorf("no cache dir")
+	}
+	path := cachePath(c.opts.cacheDir, c.target)
+	info, err := os.Stat(path)
+	if err != nil {
+		return fmt.Errorf("failed to read descriptor cache: %w", err)
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read descriptor cache: %v", err)
+	}
+	var set descriptorpb.FileDescriptorSet
+	if err = proto.Unmarshal(b, &set); err != nil {
+		return fmt.Errorf("failed to parse descriptor cache: %v", err)
+	}
+	services, err := servicesFromSet(&set)
+	if err != nil {
+		return err
+	}
+	table, err := c.route(context.Background(), &fileSource{services: services})
+	if err != nil {
+		return err
+	}
+	table.cached = true
+
+	c.updateMu.Lock()
+	defer c.updateMu.Unlock()
+	// a live table may have been published while the cache was read
+	if c.table.Load() != nil {
+		return nil
+	}
+	c.publish(table)
+	c.log.Info("serve cached descriptors", "target", c.target, "path", path,
+		"age", time.Since(info.ModTime()).Round(time.Second), "methods", len(table.methods))
+	return nil
+}
@@ -0,0 +1,245 @@
+package dynamic_proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// clientEntry is a cached client. Requests hold a reference while they use it, an entry is
+// only evicted and closed when no request holds one.
+type clientEntry struct {
+	client *ReflectClient
+	// pinned entries are never evicted, like the targets of WithTargets
+	pinned bool
+
+	mu       sync.Mutex
+	refs     int
+	lastUsed time.Time
+	closed   bool
+}
+
+// acquire takes a reference, it fails when the entry was evicted meanwhile.
+func (e *clientEntry) acquire() bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.closed {
+		return false
+	}
+	e.refs++
+	e.lastUsed = time.Now()
+	return true
+}
+
+// release drops a reference, it reports whether the entry is no longer in use.
+func (e *clientEntry) release() bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.refs--
+	e.lastUsed = time.Now()
+	return e.refs == 0
+}
+
+// idleSince returns when the entry was last used, false while it is in use or pinned.
+func (e *clientEntry) idleSince() (time.Time, bool) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.pinned || e.closed || e.refs > 0 {
+		return time.Time{}, false
+	}
+	return e.lastUsed, true
+}
+
+// WithClientIdleTTL closes the client of a target after it served no request for d,
+// 0 keeps clients forever.
+func WithClientIdleTTL(d time.Duration) ProxyOption {
+	return func(o *proxyOptions) {
+		o.idleTTL = d
+	}
+}
+
+// WithMaxClients caps the number of cached target clients, the least recently used idle one
+// is closed when a new target goes over n. Clients in use are not closed, so busy clients may
+// hold the count over n until they are released. 0 means no cap.
+func WithMaxClients(n int) ProxyOption {
+	return func(o *proxyOptions) {
+		o.maxClients = n
+	}
+}
+
+// errProxyClosed is returned for targets requested after Proxy.Close.
+var errProxyClosed = errors.New("proxy is closed")
+
+// acquire returns the client of target with a reference held, release it when the request is done.
+func (p *Proxy) acquire(ctx context.Context, target string) (*clientEntry, error) {
+	for {
+		if v, ok := p.srv.Load(target); ok {
+			if e := v.(*clientEntry); e.acquire() {
+				return e, nil
+			}
+		}
+		e, err := p.dial(ctx, target)
+		if err != nil {
+			return nil, err
+		}
+		if e != nil {
+			return e, nil
+		}
+		// evicted before this request could take it, dial again while the request is alive
+		if err = ctx.Err(); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// dial creates the entry of target, concurrent first requests share a single dial. The entry
+// is returned with a reference held, or nil when it was evicted before one could be taken.
+func (p *Proxy) dial(ctx context.Context, target string) (*clientEntry, error) {
+	// the dial outlives the request that started it, the other callers are waiting for it
+	dialCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), p.opts.timeout)
+	defer cancel()
+	created := false
+	v, err, _ := p.dials.Do(target, func() (any, error) {
+		if v, ok := p.srv.Load(target); ok {
+			return v, nil
+		}
+		if p.ctx.Err() != nil {
+			return nil, errProxyClosed
+		}
+		c, err := p.newClient(dialCtx, target)
+		if err != nil {
+			return nil, err
+		}
+		if p.ctx.Err() != nil {
+			c.Close()
+			return nil, errProxyClosed
+		}
+		// the reference of the dialing caller, so evictOverflow cannot close the new client
+		// before it served the request it was dialed for
+		e := &clientEntry{
+			client:   c,
+			pinned:   p.isTarget(target),
+			refs:     1,
+			lastUsed: time.Now(),
+		}
+		p.srv.Store(target, e)
+		created = true
+		p.evictOverflow()
+		return e, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	// Do runs the dial on the goroutine of the first caller, the others take their own reference
+	e := v.(*clientEntry)
+	if created || e.acquire() {
+		return e, nil
+	}
+	return nil, nil
+}
+
+func (p *Proxy) isTarget(target string) bool {
+	for _, t := range p.opts.targets {
+		if t == target {
+			return true
+		}
+	}
+	return false
+}
+
+// evict closes the client of target unless it is in use.
+func (p *Proxy) evict(target string, e *clientEntry) bool {
+	e.mu.Lock()
+	if e.pinned || e.closed || e.refs > 0 {
+		e.mu.Unlock()
+		return false
+	}
+	e.closed = true
+	e.mu.Unlock()
+	p.srv.CompareAndDelete(target, e)
+	if err := e.client.Close(); err != nil {
+		p.opts.log.Warn("close client fail", "target", target, "err", err)
+	}
+	return true
+}
+
+// release drops the reference of a request. An entry going idle may bring the clients back
+// under the cap that busy clients held them over.
+func (p *Proxy) release(e *clientEntry) {
+	if e.release() {
+		p.evictOverflow()
+	}
+}
+
+// evictOverflow evicts the least recently used idle clients while there are more than the cap.
+func (p *Proxy) evictOverflow() {
+	if p.opts.maxClients <= 0 {
+		return
+	}
+	p.evictMu.Lock()
+	defer p.evictMu.Unlock()
+	for {
+		count := 0
+		var (
+			oldest     *clientEntry
+			oldestKey  string
+			oldestTime time.Time
+		)
+		p.srv.Range(func(key, value any) bool {
+			count++
+			e := value.(*clientEntry)
+			if since, ok := e.idleSince(); ok && (oldest == nil || since.Before(oldestTime)) {
+				oldest, oldestKey, oldestTime = e, key.(string), since
+			}
+			return true
+		})
+		// every client over the cap is busy, try again once one is released
+		if count <= p.opts.maxClients || oldest == nil {
+			return
+		}
+		if p.evict(oldestKey, oldest) {
+			p.opts.log.Info("evict client", "target", oldestKey, "reason", "max clients")
+		}
+	}
+}
+
+// evictIdle closes the clients unused for the idle TTL until ctx is done.
+func (p *Proxy) evictIdle(ctx context.Context) {
+	ticker := time.NewTicker(max(p.opts.idleTTL/2, time.Millisecond))
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		p.srv.Range(func(key, value any) bool {
+			e := value.(*clientEntry)
+			if since, ok := e.idleSince(); ok && time.Since(since) >= p.opts.idleTTL && p.evict(key.(string), e) {
+				p.opts.log.Info("evict client", "target", key, "reason", "idle")
+			}
+			return true
+		})
+	}
+}
+
+// Close stops the background work of the proxy and closes the clients of every target, requests
+// still using them fail.
+func (p *Proxy) Close() error {
+	p.cancel()
+	var errs []error
+	p.srv.Range(func(key, value any) bool {
+		e := value.(*clientEntry)
+		e.mu.Lock()
+		e.closed = true
+		e.mu.Unlock()
+		p.srv.Delete(key)
+		if err := e.client.Close(); err != nil {
+			errs = append(errs, fmt.Errorf("failed to close client %s: %v", key, err))
+		}
+		return true
+	})
+	return errors.Join(errs...)
+}
@@ -0,0 +1,214 @@
+package dynamic_proxy
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/reflection"
+)
+
+// startTargets serves n grpc servers with reflection and returns their addresses.
+func startTargets(t *testing.T, n int) []string {
+	t.Helper()
+	var addrs []string
+	for i := 0; i < n; i++ {
+		lis, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		s := grpc.NewServer()
+		reflection.Register(s)
+		go s.Serve(lis)
+		t.Cleanup(s.Stop)
+		addrs = append(addrs, lis.Addr().String())
+	}
+	return addrs
+}
+
+// newTestProxy returns a proxy counting the dials of every target.
+func newTestProxy(t *testing.T, dials *atomic.Int64, opts ...ProxyOption) *Proxy {
+	t.Helper()
+	opts = append([]ProxyOption{
+		WithLogger(slog.New(slog.NewTextHandler(io.Discard, nil))),
+		WithTargetClientOptions(func(string) []ClientOption {
+			dials.Add(1)
+			return nil
+		}),
+	}, opts...)
+	p := NewProxy(opts...)
+	t.Cleanup(func() { p.Close() })
+	return p
+}
+
+func cachedTargets(p *Proxy) map[string]*ReflectClient {
+	clients := make(map[string]*ReflectClient)
+	p.srv.Range(func(key, value any) bool {
+		clients[key.(string)] = value.(*clientEntry).client
+		return true
+	})
+	return clients
+}
+
+func closed(c *ReflectClient) bool {
+	return c.ctx.Err() != nil
+}
+
+func TestClientSingleflight(t *testing.T) {
+	addr := startTargets(t, 1)[0]
+	var dials atomic.Int64
+	p := newTestProxy(t, &dials)
+
+	var (
+		wg      sync.WaitGroup
+		clients = make([]*ReflectClient, 20)
+	)
+	for i := range clients {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			c, release, err := p.AcquireClient(context.Background(), addr)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			defer release()
+			clients[i] = c
+		}(i)
+	}
+	wg.Wait()
+	if n := dials.Load(); n != 1 {
+		t.Errorf("dialed %d times, want 1", n)
+	}
+	for _, c := range clients {
+		if c != clients[0] {
+			t.Fatal("concurrent first requests got different clients")
+		}
+	}
+}
+
+func TestClientMaxClients(t *testing.T) {
+	addrs := startTargets(t, 3)
+	var dials atomic.Int64
+	p := newTestProxy(t, &dials, WithMaxClients(2))
+
+	// a held client is never evicted, even when it is the least recently used one
+	held, release, err := p.AcquireClient(context.Background(), addrs[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, addr := range addrs[1:] {
+		if _, err = p.Client(context.Background(), addr); err != nil {
+			t.Fatal(err)
+		}
+	}
+	clients := cachedTargets(p)
+	if len(clients) != 2 || clients[addrs[0]] != held || closed(held) {
+		t.Fatalf("cached %v, want the held client and the last one", clients)
+	}
+	if clients[addrs[2]] == nil {
+		t.Errorf("the newest client was evicted")
+	}
+	release()
+	release() // a second release is a no-op
+	if len(cachedTargets(p)) != 2 {
+		t.Errorf("cached %d clients after release, want 2", len(cachedTargets(p)))
+	}
+}
+
+func TestClientMaxClientsBusy(t *testing.T) {
+	addrs := startTargets(t, 3)
+	var dials atomic.Int64
+	p := newTestProxy(t, &dials, WithMaxClients(1))
+
+	// every target is held at once, so none of them can be evicted for the next one
+	var releases []func()
+	for _, addr := range addrs {
+		c, release, err := p.AcquireClient(context.Background(), addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if closed(c) {
+			t.Fatalf("client of %s was closed before it was used", addr)
+		}
+		releases = append(releases, release)
+	}
+	if n := dials.Load(); n != 3 {
+		t.Errorf("dialed %d times, want 3", n)
+	}
+	if n := len(cachedTargets(p)); n != 3 {
+		t.Errorf("cached %d busy clients, want 3", n)
+	}
+	// the cap holds again once the clients are released
+	for _, release := range releases {
+		release()
+	}
+	clients := cachedTargets(p)
+	if len(clients) != 1 || clients[addrs[2]] == nil {
+		t.Errorf("cached %v after release, want the last released one", clients)
+	}
+}
+
+func TestClientIdleTTL(t *testing.T) {
+	addrs := startTargets(t, 2)
+	var dials atomic.Int64
+	p := newTestProxy(t, &dials, WithClientIdleTTL(50*time.Millisecond))
+
+	idle, err := p.Client(context.Background(), addrs[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	busy, release, err := p.AcquireClient(context.Background(), addrs[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(200 * time.Millisecond)
+	if !closed(idle) || closed(busy) {
+		t.Fatalf("after the ttl: idle closed %v, busy closed %v", closed(idle), closed(busy))
+	}
+	release()
+	time.Sleep(200 * time.Millisecond)
+	if !closed(busy) || len(cachedTargets(p)) != 0 {
+		t.Errorf("released client still cached after the ttl")
+	}
+	// an evicted target is dialed again
+	if _, err = p.Client(context.Background(), addrs[0]); err != nil {
+		t.Fatal(err)
+	}
+	if n := dials.Load(); n != 3 {
+		t.Errorf("dialed %d times, want 3", n)
+	}
+}
+
+func TestClientIdleTTLTiny(t *testing.T) {
+	p := NewProxy(WithClientIdleTTL(time.Nanosecond))
+	time.Sleep(10 * time.Millisecond)
+	if err := p.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestProxyClose(t *testing.T) {
+	addr := startTargets(t, 1)[0]
+	var dials atomic.Int64
+	p := newTestProxy(t, &dials)
+	c, err := p.Client(context.Background(), addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = p.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if !closed(c) || len(cachedTargets(p)) != 0 {
+		t.Error("clients left open after Close")
+	}
+	if _, err = p.Client(context.Background(), addr); err != errProxyClosed {
+		t.Errorf("Client after Close: got %v, want %v", err, errProxyClosed)
+	}
+}
@@ -1,6 +1,8 @@
 package dynamic_proxy
 
 import (
+	"bufio"
+	"bytes"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -8,6 +10,7 @@ import (
 	"strings"
 
 	"github.com/grpc-ecosystem/grpc-gateway/v2/runtime"
+	"github.com/jhump/protoreflect/desc"
 	"github.com/jhump/protoreflect/dynamic"
 	"github.com/lemon-1997/dynamic-proxy/encoding"
 	"google.golang.org/grpc/status"
@@ -19,10 +22,12 @@ type Response struct {
 	Data   json.RawMessage `json:"data,omitempty"`
 }
 
+// CodecForRequest picks the codec of the header name, json by default. The form codec only
+// decodes, so it is never picked for Accept.
 func CodecForRequest(r *http.Request, name string) encoding.Codec {
 	for _, accept := range r.Header[name] {
 		codec := encoding.CodecBySubtype(contentSubtype(accept))
-		if codec != nil {
+		if codec != nil && !(name == "Accept" && codec.Subtype() == encoding.FormSubType) {
 			return codec
 		}
 	}
@@ -32,16 +37,84 @@ func CodecForRequest(r *http.Request, name string) encoding.Codec {
 func RequestEncode(req *http.Request, msg *dynamic.Message, pathParams map[string]string) error {
 	switch req.Method {
 	case http.MethodGet, http.MethodDelete:
-		return QueryEncode(req, msg, pathParams)
+		return RequestEncodeBody(req, msg, pathParams, "")
 	case http.MethodPost, http.MethodPut, http.MethodPatch:
+		return RequestEncodeBody(req, msg, pathParams, "*")
+	}
+	return nil
+}
+
+// RequestEncodeBody maps the request into msg following the body field of the http rule,
+// https://github.com/googleapis/googleapis/blob/master/google/api/http.proto#L46
+func RequestEncodeBody(req *http.Request, msg *dynamic.Message, pathParams map[string]string, body string) error {
+	switch body {
+	case "":
+		return QueryEncode(req, msg, pathParams)
+	case "*":
 		return BodyEncode(req, msg, pathParams)
 	}
+	md := msg.GetMessageDescriptor()
+	fd := md.FindFieldByName(body)
+	if fd == nil {
+		return fmt.Errorf("message type %s has no body field named %s", md.GetFullyQualifiedName(), body)
+	}
+	if fd.GetMessageType() != nil && !fd.IsRepeated() {
+		sub := dynamic.NewMessage(fd.GetMessageType())
+		if err := BodyEncode(req, sub, nil); err != nil {
+			return err
+		}
+		if err := msg.TrySetField(fd, sub); err != nil {
+			return fmt.Errorf("set body field error: %v", err)
+		}
+	} else if err := bodyFieldEncode(req, msg, fd); err != nil {
+		return err
+	}
+	// fields not covered by the body or the path are taken from the query
+	vs := req.URL.Query()
+	for k := range vs {
+		if k == body || strings.HasPrefix(k, body+".") {
+			vs.Del(k)
+		}
+	}
+	return queryEncode(vs.Encode(), msg, pathParams)
+}
+
+// bodyFieldEncode decodes the body into a repeated or scalar field by decoding {"<field>": <body>} into msg.
+func bodyFieldEncode(req *http.Request, msg *dynamic.Message, fd *desc.FieldDescriptor) error {
+	codec := CodecForRequest(req, "Content-Type")
+	if codec.Subtype() == encoding.FormSubType {
+		return fmt.Errorf("codec %s does not support body field %s", codec.Subtype(), fd.GetName())
+	}
+	data, err := io.ReadAll(req.Body)
+	if err != nil {
+		return fmt.Errorf("read body error: %v", err)
+	}
+	defer req.Body.Close()
+	data = bytes.TrimSpace(data)
+	if len(data) == 0 {
+		return nil
+	}
+	// a single value only, so the body cannot add sibling fields to the wrapper
+	if !json.Valid(data) {
+		return fmt.Errorf("codec unmarshal error: invalid json body")
+	}
+	name, _ := json.Marshal(fd.GetName())
+	wrapped := make([]byte, 0, len(name)+len(data)+3)
+	wrapped = append(append(append(append(wrapped, '{'), name...), ':'), data...)
+	wrapped = append(wrapped, '}')
+	if err = codec.Unmarshal(wrapped, nil, msg); err != nil {
+		return fmt.Errorf("codec unmarshal error: %v", err)
+	}
 	return nil
 }
 
 func QueryEncode(req *http.Request, msg *dynamic.Message, pathParams map[string]string) error {
+	return queryEncode(req.URL.RawQuery, msg, pathParams)
+}
+
+func queryEncode(query string, msg *dynamic.Message, pathParams map[string]string) error {
 	codec := encoding.CodecBySubtype(encoding.FormSubType)
-	if err := codec.Unmarshal([]byte(req.URL.RawQuery), pathParams, msg); err != nil {
+	if err := codec.Unmarshal([]byte(query), pathParams, msg); err != nil {
 		return fmt.Errorf("codec unmarshal error: %v", err)
 	}
 	return nil
@@ -60,9 +133,61 @@ func BodyEncode(req *http.Request, msg *dynamic.Message, pathParams map[string]s
 	return nil
 }
 
+// StreamBodyEncode decodes a newline-delimited JSON body or a top-level JSON array incrementally,
+// every element is decoded into a new message of type md and handed to send.
+func StreamBodyEncode(req *http.Request, md *desc.MessageDescriptor, pathParams map[string]string, send func(*dynamic.Message) error) error {
+	codec := CodecForRequest(req, "Content-Type")
+	if codec.Subtype() == encoding.FormSubType {
+		return fmt.Errorf("codec %s does not support streaming", codec.Subtype())
+	}
+	defer req.Body.Close()
+	br := bufio.NewReader(req.Body)
+	first, err := peekNonSpace(br)
+	if err == io.EOF {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("read body error: %v", err)
+	}
+	dec := json.NewDecoder(br)
+	array := first == '['
+	if array {
+		if _, err = dec.Token(); err != nil {
+			return fmt.Errorf("read body error: %v", err)
+		}
+	}
+	for {
+		if array && !dec.More() {
+			if _, err = dec.Token(); err != nil {
+				return fmt.Errorf("read body error: %v", err)
+			}
+			return nil
+		}
+		var raw json.RawMessage
+		if err = dec.Decode(&raw); err == io.EOF && !array {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("read body error: %v", err)
+		}
+		msg := dynamic.NewMessage(md)
+		if err = codec.Unmarshal(raw, pathParams, msg); err != nil {
+			return fmt.Errorf("codec unmarshal error: %v", err)
+		}
+		if err = send(msg); err != nil {
+			return err
+		}
+	}
+}
+
 func ResponseDecode(r *http.Request, w http.ResponseWriter, msg *dynamic.Message) error {
+	return ResponseDecodeField(r, w, msg, "")
+}
+
+// ResponseDecodeField writes only the responseBody field of msg, the whole message when it is "".
+func ResponseDecodeField(r *http.Request, w http.ResponseWriter, msg *dynamic.Message, responseBody string) error {
 	codec := CodecForRequest(r, "Accept")
-	buf, err := codec.Marshal(msg)
+	buf, err := marshalResponse(codec, msg, responseBody)
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		return fmt.Errorf("failed to marshal output JSON: %v", err)
@@ -83,12 +208,34 @@ func ResponseDecode(r *http.Request, w http.ResponseWriter, msg *dynamic.Message
 	return nil
 }
 
+// marshalResponse encodes msg, or only its responseBody field when the http rule sets one.
+func marshalResponse(codec encoding.Codec, msg *dynamic.Message, responseBody string) ([]byte, error) {
+	if responseBody == "" {
+		return codec.Marshal(msg)
+	}
+	return codec.MarshalField(msg, responseBody)
+}
+
 func DefaultHTTPError(w http.ResponseWriter, err error) {
 	grpcStatus := status.Convert(err)
 	w.WriteHeader(runtime.HTTPStatusFromCode(grpcStatus.Code()))
 	w.Write([]byte(grpcStatus.Message()))
 }
 
+func peekNonSpace(r *bufio.Reader) (byte, error) {
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			return 0, err
+		}
+		switch b {
+		case ' ', '\t', '\r', '\n':
+			continue
+		}
+		return b, r.UnreadByte()
+	}
+}
+
 func contentSubtype(contentType string) string {
 	left := strings.Index(contentType, "/")
 	if left == -1 {
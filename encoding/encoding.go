@@ -3,26 +3,32 @@ package encoding
 import (
 	"log/slog"
 	"strconv"
+	"strings"
 
 	"github.com/golang/protobuf/jsonpb"
+	"github.com/golang/protobuf/proto"
 	"github.com/jhump/protoreflect/desc"
 	"github.com/jhump/protoreflect/dynamic"
 	"google.golang.org/protobuf/types/descriptorpb"
 )
 
 var (
-	form  Codec
-	json  Codec
-	codec = map[string]Codec{}
+	form   Codec
+	json   Codec
+	ndjson Codec
+	codec  = map[string]Codec{}
 )
 
 const (
-	JsonSubType = "json"
-	FormSubType = "x-www-form-urlencoded"
+	JsonSubType   = "json"
+	FormSubType   = "x-www-form-urlencoded"
+	NdjsonSubType = "x-ndjson"
 )
 
 type Codec interface {
 	Marshal(v *dynamic.Message) ([]byte, error)
+	// MarshalField encodes only the named field of v, it backs the response_body of http rules.
+	MarshalField(v *dynamic.Message, name string) ([]byte, error)
 	Unmarshal(data []byte, params map[string]string, v *dynamic.Message) error
 	Subtype() string
 }
@@ -39,14 +45,74 @@ func Register(marshalOpt *jsonpb.Marshaler, unmarshalOpt *jsonpb.Unmarshaler, lo
 		marshalOpt:   marshalOpt,
 		unmarshalOpt: unmarshalOpt,
 	}
+	ndjson = &ndjsonCodec{
+		jsonCodec: jsonCodec{
+			log:          log,
+			marshalOpt:   marshalOpt,
+			unmarshalOpt: unmarshalOpt,
+		},
+	}
 	codec[form.Subtype()] = form
 	codec[json.Subtype()] = json
+	codec[ndjson.Subtype()] = ndjson
 }
 
 func CodecBySubtype(subtype string) Codec {
 	return codec[subtype]
 }
 
+// findField resolves a dotted field path like "book.author.id" against msg, creating the
+// intermediate messages on the way. It returns the message owning the last field, or a nil
+// field descriptor when the path does not name a field, msg is left untouched then.
+func findField(msg *dynamic.Message, path string) (*dynamic.Message, *desc.FieldDescriptor, error) {
+	names := strings.Split(path, ".")
+	fields := make([]*desc.FieldDescriptor, 0, len(names))
+	md := msg.GetMessageDescriptor()
+	for i, name := range names {
+		fd := md.FindFieldByName(name)
+		if fd == nil {
+			fd = md.FindFieldByJSONName(name)
+		}
+		if fd == nil {
+			return nil, nil, nil
+		}
+		fields = append(fields, fd)
+		if i == len(names)-1 {
+			break
+		}
+		if fd.GetMessageType() == nil || fd.IsRepeated() {
+			return nil, nil, nil
+		}
+		md = fd.GetMessageType()
+	}
+	// the whole path exists, only now the intermediate messages are set
+	for _, fd := range fields[:len(fields)-1] {
+		// an unset proto2 field reads as a detached default message, so only set fields are reused
+		var sub *dynamic.Message
+		if msg.HasField(fd) {
+			val, err := msg.TryGetField(fd)
+			if err != nil {
+				return nil, nil, err
+			}
+			sub, _ = val.(*dynamic.Message)
+			if pm, ok := val.(proto.Message); ok && sub == nil && pm != nil {
+				sub = dynamic.NewMessage(fd.GetMessageType())
+				if err = sub.MergeFrom(pm); err != nil {
+					return nil, nil, err
+				}
+			}
+		}
+		if sub == nil {
+			sub = dynamic.NewMessage(fd.GetMessageType())
+		}
+		if err := msg.TrySetField(fd, sub); err != nil {
+			return nil, nil, err
+		}
+		msg = sub
+	}
+	return msg, fields[len(fields)-1], nil
+}
+
 func decodeFields(fd *desc.FieldDescriptor, val string) interface{} {
 	switch fd.GetType() {
 	case descriptorpb.FieldDescriptorProto_TYPE_ENUM:
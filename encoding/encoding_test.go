@@ -0,0 +1,95 @@
+package encoding
+
+import (
+	"log/slog"
+	"testing"
+
+	"github.com/golang/protobuf/jsonpb"
+	"github.com/jhump/protoreflect/desc"
+	"github.com/jhump/protoreflect/dynamic"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/known/sourcecontextpb"
+	"google.golang.org/protobuf/types/known/typepb"
+)
+
+func TestNestedFields(t *testing.T) {
+	form := &formCodec{log: slog.Default(), unmarshalOpt: &jsonpb.Unmarshaler{}}
+	lenient := &formCodec{log: slog.Default(), unmarshalOpt: &jsonpb.Unmarshaler{AllowUnknownFields: true}}
+	json := &jsonCodec{log: slog.Default()}
+	tests := []struct {
+		name   string
+		codec  Codec
+		data   string
+		params map[string]string
+		want   proto.Message
+	}{
+		{
+			name:  "proto2 query",
+			codec: form,
+			data:  "name=x&options.deprecated=true&options.lazy=true",
+			want: &descriptorpb.FieldDescriptorProto{
+				Name:    proto.String("x"),
+				Options: &descriptorpb.FieldOptions{Deprecated: proto.Bool(true), Lazy: proto.Bool(true)},
+			},
+		},
+		{
+			name:  "proto2 unknown leaf",
+			codec: lenient,
+			data:  "name=x&options.bogus=1",
+			want:  &descriptorpb.FieldDescriptorProto{Name: proto.String("x")},
+		},
+		{
+			name:   "proto2 path param over body",
+			codec:  json,
+			data:   `{"name":"x","options":{"lazy":true}}`,
+			params: map[string]string{"options.deprecated": "true"},
+			want: &descriptorpb.FieldDescriptorProto{
+				Name:    proto.String("x"),
+				Options: &descriptorpb.FieldOptions{Deprecated: proto.Bool(true), Lazy: proto.Bool(true)},
+			},
+		},
+		{
+			name:  "proto3 query",
+			codec: form,
+			data:  "name=T&source_context.file_name=a.proto",
+			want: &typepb.Type{
+				Name:          "T",
+				SourceContext: &sourcecontextpb.SourceContext{FileName: "a.proto"},
+			},
+		},
+		{
+			name:   "proto3 path param",
+			codec:  json,
+			data:   `{"name":"T"}`,
+			params: map[string]string{"source_context.file_name": "a.proto"},
+			want: &typepb.Type{
+				Name:          "T",
+				SourceContext: &sourcecontextpb.SourceContext{FileName: "a.proto"},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			md, err := desc.WrapMessage(tt.want.ProtoReflect().Descriptor())
+			if err != nil {
+				t.Fatal(err)
+			}
+			msg := dynamic.NewMessage(md)
+			if err = tt.codec.Unmarshal([]byte(tt.data), tt.params, msg); err != nil {
+				t.Fatal(err)
+			}
+			b, err := msg.Marshal()
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := tt.want.ProtoReflect().New().Interface()
+			if err = proto.Unmarshal(b, got); err != nil {
+				t.Fatal(err)
+			}
+			if !proto.Equal(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -19,6 +19,10 @@ func (formCodec) Marshal(_ *dynamic.Message) ([]byte, error) {
 	panic("not implemented")
 }
 
+func (formCodec) MarshalField(_ *dynamic.Message, _ string) ([]byte, error) {
+	return nil, fmt.Errorf("codec %s does not support marshal", FormSubType)
+}
+
 func (c formCodec) Unmarshal(data []byte, pathParams map[string]string, msg *dynamic.Message) error {
 	vs, err := url.ParseQuery(string(data))
 	if err != nil {
@@ -31,15 +35,15 @@ func (c formCodec) Unmarshal(data []byte, pathParams map[string]string, msg *dyn
 		if len(v) == 0 {
 			continue
 		}
-		fd := msg.GetMessageDescriptor().FindFieldByName(k)
+		owner, fd, err := findField(msg, k)
+		if err != nil {
+			return err
+		}
 		if fd == nil {
-			fd = msg.GetMessageDescriptor().FindFieldByJSONName(k)
-			if fd == nil {
-				if c.unmarshalOpt.AllowUnknownFields {
-					continue
-				}
-				return fmt.Errorf("message type %s has no known field named %s", msg.GetMessageDescriptor().GetFullyQualifiedName(), k)
+			if c.unmarshalOpt.AllowUnknownFields {
+				continue
 			}
+			return fmt.Errorf("message type %s has no known field named %s", msg.GetMessageDescriptor().GetFullyQualifiedName(), k)
 		}
 		if fd.UnwrapField().IsList() {
 			var list []interface{}
@@ -50,7 +54,7 @@ func (c formCodec) Unmarshal(data []byte, pathParams map[string]string, msg *dyn
 				}
 				list = append(list, val)
 			}
-			if err = msg.TrySetFieldByName(fd.GetName(), list); err != nil {
+			if err = owner.TrySetField(fd, list); err != nil {
 				c.log.Warn("unmarshal set field fail", "field", k, "err", err)
 			}
 			continue
@@ -59,7 +63,7 @@ func (c formCodec) Unmarshal(data []byte, pathParams map[string]string, msg *dyn
 		if val == nil {
 			continue
 		}
-		if err = msg.TrySetFieldByName(fd.GetName(), val); err != nil {
+		if err = owner.TrySetField(fd, val); err != nil {
 			c.log.Warn("unmarshal set field fail", "field", k, "err", err)
 		}
 	}
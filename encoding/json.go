@@ -1,6 +1,9 @@
 package encoding
 
 import (
+	"bytes"
+	stdjson "encoding/json"
+	"fmt"
 	"log/slog"
 
 	"github.com/golang/protobuf/jsonpb"
@@ -17,9 +20,36 @@ func (jsonCodec) Marshal(msg *dynamic.Message) ([]byte, error) {
 	return msg.MarshalJSONPB(&jsonpb.Marshaler{OrigName: true, EmitDefaults: true})
 }
 
+func (c jsonCodec) MarshalField(msg *dynamic.Message, name string) ([]byte, error) {
+	md := msg.GetMessageDescriptor()
+	fd := md.FindFieldByName(name)
+	if fd == nil {
+		return nil, fmt.Errorf("message type %s has no known field named %s", md.GetFullyQualifiedName(), name)
+	}
+	// marshal the whole message so the field keeps the jsonpb format of its type
+	buf, err := c.Marshal(msg)
+	if err != nil {
+		return nil, err
+	}
+	var fields map[string]stdjson.RawMessage
+	if err = stdjson.Unmarshal(buf, &fields); err != nil {
+		return nil, err
+	}
+	return fields[fd.GetName()], nil
+}
+
 func (c jsonCodec) Unmarshal(data []byte, pathParams map[string]string, msg *dynamic.Message) error {
+	if len(bytes.TrimSpace(data)) > 0 {
+		if err := msg.UnmarshalJSONPB(&jsonpb.Unmarshaler{AllowUnknownFields: true}, data); err != nil {
+			return err
+		}
+	}
+	// path params take precedence over the body
 	for k, v := range pathParams {
-		fd := msg.GetMessageDescriptor().FindFieldByName(k)
+		owner, fd, err := findField(msg, k)
+		if err != nil {
+			return err
+		}
 		if fd == nil {
 			continue
 		}
@@ -27,11 +57,11 @@ func (c jsonCodec) Unmarshal(data []byte, pathParams map[string]string, msg *dyn
 		if val == nil {
 			continue
 		}
-		if err := msg.TrySetFieldByName(k, val); err != nil {
+		if err = owner.TrySetField(fd, val); err != nil {
 			c.log.Warn("unmarshal set field fail", "field", k, "err", err)
 		}
 	}
-	return msg.UnmarshalJSONPB(&jsonpb.Unmarshaler{AllowUnknownFields: true}, data)
+	return nil
 }
 
 func (jsonCodec) Subtype() string {
@@ -0,0 +1,11 @@
+package encoding
+
+// ndjsonCodec encodes every message as a single line of JSON, it is used by
+// streaming responses that write one message per line.
+type ndjsonCodec struct {
+	jsonCodec
+}
+
+func (ndjsonCodec) Subtype() string {
+	return NdjsonSubType
+}
@@ -0,0 +1,179 @@
+package dynamic_proxy
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	refv1alpha "google.golang.org/grpc/reflection/grpc_reflection_v1alpha"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+)
+
+// ReflectionSourceWithFallback asks the target through gRPC reflection like ReflectionSource,
+// files, symbols and extensions the target does not know are resolved from pool instead.
+// protoregistry.GlobalFiles covers everything linked into the binary, such as google/api/http.proto.
+func ReflectionSourceWithFallback(pool *protoregistry.Files) DescriptorSourceFunc {
+	return func(_ string, conn grpc.ClientConnInterface) (DescriptorSource, error) {
+		return &reflectionSource{conn: &fallbackConn{ClientConnInterface: conn, pool: pool}}, nil
+	}
+}
+
+// NewDescriptorPool loads a supplementary pool from FileDescriptorSet files, directories are
+// searched for *.protoset files.
+func NewDescriptorPool(paths ...string) (*protoregistry.Files, error) {
+	files, err := listFiles(paths, ".protoset")
+	if err != nil {
+		return nil, fmt.Errorf("failed to list descriptor files: %v", err)
+	}
+	set, err := readProtosets(files)
+	if err != nil {
+		return nil, err
+	}
+	pool, err := protodesc.NewFiles(set)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create descriptor pool: %v", err)
+	}
+	return pool, nil
+}
+
+// fallbackConn answers the NOT_FOUND replies of the reflection stream from a local pool,
+// the reflection client never sees that the target was missing the file.
+type fallbackConn struct {
+	grpc.ClientConnInterface
+	pool *protoregistry.Files
+}
+
+func (c *fallbackConn) NewStream(ctx context.Context, desc *grpc.StreamDesc, method string, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+	s, err := c.ClientConnInterface.NewStream(ctx, desc, method, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return &fallbackStream{ClientStream: s, pool: c.pool}, nil
+}
+
+// fallbackStream works for both v1 and v1alpha, the messages are wire compatible
+// and read as v1alpha.
+type fallbackStream struct {
+	grpc.ClientStream
+	pool *protoregistry.Files
+	mu   sync.Mutex
+	// sent holds the requests not answered yet, replies come back in order
+	sent []*refv1alpha.ServerReflectionRequest
+}
+
+func (s *fallbackStream) SendMsg(m any) error {
+	req := &refv1alpha.ServerReflectionRequest{}
+	if err := convertMessage(m, req); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	s.sent = append(s.sent, req)
+	s.mu.Unlock()
+	return s.ClientStream.SendMsg(m)
+}
+
+func (s *fallbackStream) RecvMsg(m any) error {
+	if err := s.ClientStream.RecvMsg(m); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	if len(s.sent) == 0 {
+		s.mu.Unlock()
+		return nil
+	}
+	req := s.sent[0]
+	s.sent = s.sent[1:]
+	s.mu.Unlock()
+
+	res := &refv1alpha.ServerReflectionResponse{}
+	if err := convertMessage(m, res); err != nil {
+		return err
+	}
+	if res.GetErrorResponse().GetErrorCode() != int32(codes.NotFound) {
+		return nil
+	}
+	fd := s.lookup(req)
+	if fd == nil {
+		return nil
+	}
+	b, err := proto.Marshal(protodesc.ToFileDescriptorProto(fd))
+	if err != nil {
+		return fmt.Errorf("failed to marshal fallback descriptor: %v", err)
+	}
+	return convertMessage(&refv1alpha.ServerReflectionResponse{
+		ValidHost:       res.GetValidHost(),
+		OriginalRequest: req,
+		MessageResponse: &refv1alpha.ServerReflectionResponse_FileDescriptorResponse{
+			FileDescriptorResponse: &refv1alpha.FileDescriptorResponse{
+				FileDescriptorProto: [][]byte{b},
+			},
+		},
+	}, m)
+}
+
+func (s *fallbackStream) lookup(req *refv1alpha.ServerReflectionRequest) protoreflect.FileDescriptor {
+	switch r := req.GetMessageRequest().(type) {
+	case *refv1alpha.ServerReflectionRequest_FileByFilename:
+		if fd, err := s.pool.FindFileByPath(r.FileByFilename); err == nil {
+			return fd
+		}
+	case *refv1alpha.ServerReflectionRequest_FileContainingSymbol:
+		if d, err := s.pool.FindDescriptorByName(protoreflect.FullName(r.FileContainingSymbol)); err == nil {
+			return d.ParentFile()
+		}
+	case *refv1alpha.ServerReflectionRequest_FileContainingExtension:
+		return findExtensionFile(s.pool, r.FileContainingExtension.GetContainingType(), r.FileContainingExtension.GetExtensionNumber())
+	}
+	return nil
+}
+
+func findExtensionFile(pool *protoregistry.Files, extendee string, number int32) protoreflect.FileDescriptor {
+	var found protoreflect.FileDescriptor
+	var find func(exts protoreflect.ExtensionDescriptors, msgs protoreflect.MessageDescriptors) bool
+	find = func(exts protoreflect.ExtensionDescriptors, msgs protoreflect.MessageDescriptors) bool {
+		for i := 0; i < exts.Len(); i++ {
+			ext := exts.Get(i)
+			if string(ext.ContainingMessage().FullName()) == extendee && int32(ext.Number()) == number {
+				return true
+			}
+		}
+		for i := 0; i < msgs.Len(); i++ {
+			if find(msgs.Get(i).Extensions(), msgs.Get(i).Messages()) {
+				return true
+			}
+		}
+		return false
+	}
+	pool.RangeFiles(func(fd protoreflect.FileDescriptor) bool {
+		if find(fd.Extensions(), fd.Messages()) {
+			found = fd
+			return false
+		}
+		return true
+	})
+	return found
+}
+
+// convertMessage copies between messages with the same wire format, such as the v1 and
+// v1alpha reflection messages.
+func convertMessage(from, to any) error {
+	src, ok := from.(proto.Message)
+	if !ok {
+		return fmt.Errorf("unexpected reflection message %T", from)
+	}
+	dst, ok := to.(proto.Message)
+	if !ok {
+		return fmt.Errorf("unexpected reflection message %T", to)
+	}
+	b, err := proto.Marshal(src)
+	if err != nil {
+		return err
+	}
+	proto.Reset(dst)
+	return proto.Unmarshal(b, dst)
+}
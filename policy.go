@@ -0,0 +1,232 @@
+package dynamic_proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"path"
+	"strings"
+	"syscall"
+
+	"google.golang.org/grpc"
+)
+
+// ErrTargetDenied is returned by Proxy.Client for targets the TargetPolicy does not allow.
+var ErrTargetDenied = errors.New("target denied")
+
+// TargetPolicy decides which targets the proxy may dial. Rules are CIDRs ("10.0.0.0/8"),
+// IP addresses or hostname globs ("*.svc.cluster.local"), ports are not matched.
+// A target matching a deny rule is denied, and when there are allow rules a target has to
+// match one of them. Hostnames are resolved for the CIDR rules and every address must pass.
+type TargetPolicy struct {
+	allow    []targetRule
+	deny     []targetRule
+	resolver *net.Resolver
+}
+
+type targetRule struct {
+	prefix netip.Prefix
+	glob   string
+}
+
+func NewTargetPolicy(allow, deny []string) (*TargetPolicy, error) {
+	p := &TargetPolicy{resolver: net.DefaultResolver}
+	var err error
+	if p.allow, err = parseTargetRules(allow); err != nil {
+		return nil, err
+	}
+	if p.deny, err = parseTargetRules(deny); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+func parseTargetRules(rules []string) ([]targetRule, error) {
+	parsed := make([]targetRule, 0, len(rules))
+	for _, rule := range rules {
+		if prefix, err := netip.ParsePrefix(rule); err == nil {
+			parsed = append(parsed, targetRule{prefix: prefix.Masked()})
+			continue
+		}
+		if addr, err := netip.ParseAddr(rule); err == nil {
+			parsed = append(parsed, targetRule{prefix: netip.PrefixFrom(addr, addr.BitLen())})
+			continue
+		}
+		glob := strings.ToLower(rule)
+		if _, err := path.Match(glob, ""); err != nil {
+			return nil, fmt.Errorf("invalid target rule %q: %v", rule, err)
+		}
+		parsed = append(parsed, targetRule{glob: glob})
+	}
+	return parsed, nil
+}
+
+// Check returns an error wrapping ErrTargetDenied when target may not be dialed.
+func (p *TargetPolicy) Check(ctx context.Context, target string) error {
+	if p == nil {
+		return nil
+	}
+	host := policyHost(target)
+	var (
+		resolved  bool
+		addrs     []netip.Addr
+		lookupErr error
+	)
+	// hostnames are only resolved when a CIDR rule is reached
+	lookup := func() ([]netip.Addr, error) {
+		if !resolved {
+			resolved = true
+			addrs, lookupErr = p.lookup(ctx, host)
+		}
+		return addrs, lookupErr
+	}
+	if glob, ok := matchGlob(p.deny, host); ok {
+		return fmt.Errorf("%w: %s matches deny rule %s", ErrTargetDenied, target, glob)
+	}
+	if hasPrefixRules(p.deny) {
+		addrs, err := lookup()
+		if err != nil {
+			return fmt.Errorf("%w: %s: %v", ErrTargetDenied, target, err)
+		}
+		for _, addr := range addrs {
+			if err = checkDeny(p.deny, target, addr); err != nil {
+				return err
+			}
+		}
+	}
+	if len(p.allow) == 0 {
+		return nil
+	}
+	if _, ok := matchGlob(p.allow, host); ok {
+		return nil
+	}
+	for _, rule := range p.allow {
+		if rule.glob != "" {
+			continue
+		}
+		addrs, err := lookup()
+		if err != nil || len(addrs) == 0 {
+			break
+		}
+		allowed := true
+		for _, addr := range addrs {
+			allowed = allowed && rule.prefix.Contains(addr)
+		}
+		if allowed {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: %s is not allowed", ErrTargetDenied, target)
+}
+
+// dialOption checks the CIDR rules again on every address dialed for target. Check resolves the
+// name once while gRPC resolves it on every connect, so a name pointed elsewhere in between
+// (DNS rebinding) is caught here. It is nil when there are no CIDR rules.
+func (p *TargetPolicy) dialOption(target string) grpc.DialOption {
+	check := p.dialCheck(target)
+	if check == nil {
+		return nil
+	}
+	dialer := &net.Dialer{Control: func(_, address string, _ syscall.RawConn) error {
+		return check(address)
+	}}
+	return grpc.WithContextDialer(func(ctx context.Context, addr string) (net.Conn, error) {
+		return dialer.DialContext(ctx, "tcp", addr)
+	})
+}
+
+// dialCheck returns the check of the "ip:port" addresses dialed for target.
+func (p *TargetPolicy) dialCheck(target string) func(address string) error {
+	if p == nil || !hasPrefixRules(p.deny) && !hasPrefixRules(p.allow) {
+		return nil
+	}
+	// a target allowed by a hostname glob is not held to the allowed CIDRs
+	_, globAllowed := matchGlob(p.allow, policyHost(target))
+	checkAllow := hasPrefixRules(p.allow) && !globAllowed
+	return func(address string) error {
+		ap, err := netip.ParseAddrPort(address)
+		if err != nil {
+			return fmt.Errorf("%w: %s: dialed address %s: %v", ErrTargetDenied, target, address, err)
+		}
+		addr := ap.Addr().Unmap()
+		if err = checkDeny(p.deny, target, addr); err != nil {
+			return err
+		}
+		if !checkAllow {
+			return nil
+		}
+		for _, rule := range p.allow {
+			if rule.glob == "" && rule.prefix.Contains(addr) {
+				return nil
+			}
+		}
+		return fmt.Errorf("%w: %s dialed %s which is not allowed", ErrTargetDenied, target, addr)
+	}
+}
+
+func checkDeny(rules []targetRule, target string, addr netip.Addr) error {
+	for _, rule := range rules {
+		if rule.glob == "" && rule.prefix.Contains(addr) {
+			return fmt.Errorf("%w: %s resolves to %s matching deny rule %s", ErrTargetDenied, target, addr, rule.prefix)
+		}
+	}
+	return nil
+}
+
+func matchGlob(rules []targetRule, host string) (string, bool) {
+	for _, rule := range rules {
+		if rule.glob == "" {
+			continue
+		}
+		if ok, _ := path.Match(rule.glob, host); ok {
+			return rule.glob, true
+		}
+	}
+	return "", false
+}
+
+func hasPrefixRules(rules []targetRule) bool {
+	for _, rule := range rules {
+		if rule.glob == "" {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *TargetPolicy) lookup(ctx context.Context, host string) ([]netip.Addr, error) {
+	if addr, err := netip.ParseAddr(host); err == nil {
+		return []netip.Addr{addr.Unmap()}, nil
+	}
+	ips, err := p.resolver.LookupNetIP(ctx, "ip", host)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve host: %v", err)
+	}
+	addrs := make([]netip.Addr, 0, len(ips))
+	for _, ip := range ips {
+		addrs = append(addrs, ip.Unmap())
+	}
+	return addrs, nil
+}
+
+// policyHost is the lower case host of target without the trailing dot of a fully qualified name,
+// so "Metadata.Internal." is matched like "metadata.internal".
+func policyHost(target string) string {
+	return strings.TrimSuffix(strings.ToLower(targetHost(target)), ".")
+}
+
+// targetHost returns the host of a grpc target such as "host:port" or "dns:///host:port".
+func targetHost(target string) string {
+	if i := strings.Index(target, "://"); i >= 0 {
+		target = target[i+3:]
+		if j := strings.Index(target, "/"); j >= 0 {
+			target = target[j+1:]
+		}
+	}
+	if host, _, err := net.SplitHostPort(target); err == nil {
+		return host
+	}
+	return strings.Trim(target, "[]")
+}
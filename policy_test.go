@@ -0,0 +1,136 @@
+package dynamic_proxy
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+)
+
+// offlineResolver answers from /etc/hosts only, every DNS query fails.
+var offlineResolver = &net.Resolver{
+	PreferGo: true,
+	Dial: func(context.Context, string, string) (net.Conn, error) {
+		return nil, errors.New("dns is offline")
+	},
+}
+
+func TestTargetPolicyCheck(t *testing.T) {
+	tests := []struct {
+		name   string
+		allow  []string
+		deny   []string
+		target string
+		denied bool
+	}{
+		{name: "deny cidr", deny: []string{"10.0.0.0/8"}, target: "10.1.2.3:50051", denied: true},
+		{name: "outside deny cidr", deny: []string{"10.0.0.0/8"}, target: "11.0.0.1:50051"},
+		{name: "deny bare ip", deny: []string{"169.254.169.254"}, target: "169.254.169.254:80", denied: true},
+		{name: "deny bare ip mapped", deny: []string{"169.254.169.254"}, target: "[::ffff:169.254.169.254]:80", denied: true},
+		{name: "deny ipv6 cidr", deny: []string{"fd00::/8"}, target: "[fd00::1]:80", denied: true},
+		{name: "deny glob", deny: []string{"*.internal"}, target: "metadata.internal:50051", denied: true},
+		{name: "deny glob upper case", deny: []string{"*.internal"}, target: "Metadata.INTERNAL:50051", denied: true},
+		{name: "deny glob trailing dot", deny: []string{"*.internal"}, target: "metadata.internal.:50051", denied: true},
+		{name: "deny glob without port", deny: []string{"*.internal"}, target: "metadata.internal", denied: true},
+		{name: "deny glob dns scheme", deny: []string{"*.internal"}, target: "dns:///metadata.internal:443", denied: true},
+		{name: "deny glob dns authority", deny: []string{"*.internal"}, target: "dns://8.8.8.8/metadata.internal.:443", denied: true},
+		{name: "deny cidr by hostname", deny: []string{"127.0.0.0/8"}, target: "localhost:50051", denied: true},
+		{name: "deny cidr lookup failure", deny: []string{"10.0.0.0/8"}, target: "books.invalid:50051", denied: true},
+		{name: "deny glob no lookup", deny: []string{"*.internal"}, target: "books.invalid:50051"},
+		{name: "allow glob", allow: []string{"*.svc.local"}, target: "books.svc.local:50051"},
+		{name: "allow glob trailing dot", allow: []string{"*.svc.local"}, target: "books.svc.local.:50051"},
+		{name: "outside allow glob", allow: []string{"*.svc.local"}, target: "books.other:50051", denied: true},
+		{name: "allow cidr", allow: []string{"10.0.0.0/8"}, target: "10.0.0.1:50051"},
+		{name: "outside allow cidr", allow: []string{"10.0.0.0/8"}, target: "192.168.0.1:50051", denied: true},
+		{name: "allow cidr by hostname", allow: []string{"127.0.0.0/8"}, target: "localhost:50051"},
+		{name: "allow cidr lookup failure", allow: []string{"10.0.0.0/8"}, target: "books.invalid:50051", denied: true},
+		{name: "deny over allow", allow: []string{"10.0.0.0/8"}, deny: []string{"10.0.0.1"}, target: "10.0.0.1:50051", denied: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, err := NewTargetPolicy(tt.allow, tt.deny)
+			if err != nil {
+				t.Fatal(err)
+			}
+			p.resolver = offlineResolver
+			err = p.Check(context.Background(), tt.target)
+			if denied := errors.Is(err, ErrTargetDenied); denied != tt.denied {
+				t.Errorf("Check(%s) = %v, want denied %v", tt.target, err, tt.denied)
+			}
+		})
+	}
+}
+
+func TestTargetPolicyInvalidRule(t *testing.T) {
+	if _, err := NewTargetPolicy([]string{"[a-"}, nil); err == nil {
+		t.Error("NewTargetPolicy accepted an invalid glob")
+	}
+}
+
+func TestTargetPolicyDial(t *testing.T) {
+	tests := []struct {
+		name    string
+		allow   []string
+		deny    []string
+		target  string
+		address string
+		denied  bool
+	}{
+		{name: "rebound into deny cidr", deny: []string{"10.0.0.0/8"}, target: "books.example.com:443", address: "10.0.0.5:443", denied: true},
+		{name: "outside deny cidr", deny: []string{"10.0.0.0/8"}, target: "books.example.com:443", address: "93.184.216.34:443"},
+		{name: "mapped deny address", deny: []string{"10.0.0.0/8"}, target: "books.example.com:443", address: "[::ffff:10.0.0.5]:443", denied: true},
+		{name: "rebound out of allow cidr", allow: []string{"10.0.0.0/8"}, target: "books.example.com:443", address: "169.254.169.254:80", denied: true},
+		{name: "inside allow cidr", allow: []string{"10.0.0.0/8"}, target: "books.example.com:443", address: "10.0.0.5:443"},
+		{name: "allowed by glob", allow: []string{"*.svc.local", "10.0.0.0/8"}, target: "books.svc.local:443", address: "192.168.0.1:443"},
+		{name: "allowed by glob still denied", allow: []string{"*.svc.local"}, deny: []string{"169.254.0.0/16"}, target: "books.svc.local:443", address: "169.254.169.254:80", denied: true},
+		{name: "not an ip", deny: []string{"10.0.0.0/8"}, target: "books.example.com:443", address: "books.example.com:443", denied: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, err := NewTargetPolicy(tt.allow, tt.deny)
+			if err != nil {
+				t.Fatal(err)
+			}
+			check := p.dialCheck(tt.target)
+			if check == nil {
+				t.Fatal("no dial check for cidr rules")
+			}
+			err = check(tt.address)
+			if denied := errors.Is(err, ErrTargetDenied); denied != tt.denied {
+				t.Errorf("dial %s = %v, want denied %v", tt.address, err, tt.denied)
+			}
+		})
+	}
+}
+
+func TestTargetPolicyDialConn(t *testing.T) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lis.Close()
+	p, err := NewTargetPolicy(nil, []string{"127.0.0.0/8"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Check is skipped, as if the name had resolved elsewhere before it was dialed
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	conn, err := grpc.DialContext(ctx, lis.Addr().String(),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithBlock(),
+		grpc.WithReturnConnectionError(),
+		p.dialOption(lis.Addr().String()),
+	)
+	if err == nil {
+		conn.Close()
+	}
+	if err == nil || !strings.Contains(err.Error(), ErrTargetDenied.Error()) {
+		t.Errorf("dial %s = %v, want denied", lis.Addr(), err)
+	}
+}
@@ -2,18 +2,24 @@ package dynamic_proxy
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log/slog"
+	"net"
 	"net/http"
 	"os"
+	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/golang/protobuf/jsonpb"
+	"github.com/gorilla/websocket"
 	"github.com/grpc-ecosystem/grpc-gateway/v2/runtime"
 	"github.com/jhump/protoreflect/dynamic"
 	"github.com/lemon-1997/dynamic-proxy/encoding"
+	"golang.org/x/sync/singleflight"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/credentials/insecure"
 	"google.golang.org/grpc/metadata"
@@ -21,13 +27,26 @@ import (
 
 type Proxy struct {
 	opts proxyOptions
-	srv  sync.Map
+	// srv holds a *clientEntry per target
+	srv   sync.Map
+	dials singleflight.Group
+	// evictMu serializes evictOverflow, so concurrent calls do not evict more than needed
+	evictMu sync.Mutex
+	// unified holds the merged routes of all targets when WithTargets is set
+	unifiedMu sync.Mutex
+	unified   atomic.Pointer[routeTable]
+	// ctx is done once the proxy is closed
+	ctx    context.Context
+	cancel context.CancelFunc
 }
 
 type ProxyOption func(*proxyOptions)
 
 type PathExtractFunc func(string) (grpcTarget string, httpRoute string)
 
+// RequestExtractFunc picks the target of a request and the path routed within it.
+type RequestExtractFunc func(r *http.Request) (grpcTarget string, httpRoute string)
+
 type ErrorDecodeFunc func(w http.ResponseWriter, err error)
 
 type proxyOptions struct {
@@ -38,8 +57,18 @@ type proxyOptions struct {
 	incomingHeaderMatcher runtime.HeaderMatcherFunc
 	outgoingHeaderMatcher runtime.HeaderMatcherFunc
 	pathExtract           PathExtractFunc
+	requestExtract        RequestExtractFunc
 	errDecoder            ErrorDecodeFunc
 	grpcOpts              []grpc.DialOption
+	upgrader              *websocket.Upgrader
+	source                DescriptorSourceFunc
+	clientOpts            []ClientOption
+	targetOpts            func(target string) []ClientOption
+	targets               []string
+	registry              *Registry
+	policy                *TargetPolicy
+	idleTTL               time.Duration
+	maxClients            int
 }
 
 func WithLogger(logger *slog.Logger) ProxyOption {
@@ -78,6 +107,14 @@ func WithPathExtract(f PathExtractFunc) ProxyOption {
 	}
 }
 
+// WithRequestExtract picks the target from the whole request, such as HostExtract or
+// HeaderExtract, instead of the path extractor.
+func WithRequestExtract(f RequestExtractFunc) ProxyOption {
+	return func(o *proxyOptions) {
+		o.requestExtract = f
+	}
+}
+
 func WithTimeout(d time.Duration) ProxyOption {
 	return func(o *proxyOptions) {
 		o.timeout = d
@@ -96,6 +133,53 @@ func WithGrpcOpts(opts ...grpc.DialOption) ProxyOption {
 	}
 }
 
+func WithUpgrader(u *websocket.Upgrader) ProxyOption {
+	return func(o *proxyOptions) {
+		o.upgrader = u
+	}
+}
+
+// WithDescriptorSource sets where each target's services are resolved from, gRPC reflection by default.
+func WithDescriptorSource(f DescriptorSourceFunc) ProxyOption {
+	return func(o *proxyOptions) {
+		o.source = f
+	}
+}
+
+// WithClientOptions sets options applied to the client of every target.
+func WithClientOptions(opts ...ClientOption) ProxyOption {
+	return func(o *proxyOptions) {
+		o.clientOpts = opts
+	}
+}
+
+// WithTargetClientOptions adds the options returned by f to the client of each target, applied
+// after WithClientOptions. Use it for per target reflection metadata or credentials.
+func WithTargetClientOptions(f func(target string) []ClientOption) ProxyOption {
+	return func(o *proxyOptions) {
+		o.targetOpts = f
+	}
+}
+
+// WithRegistry only serves the targets of r, dialed with their own address and settings. The
+// first path segment is taken as the target alias, unless WithPathExtract is given after it
+// or WithRequestExtract is set.
+func WithRegistry(r *Registry) ProxyOption {
+	return func(o *proxyOptions) {
+		o.registry = r
+		o.pathExtract = r.PathExtract
+	}
+}
+
+// WithTargetPolicy only dials the targets allowed by policy, requests for other targets get 403.
+// The CIDR rules are checked again on every address dialed, which replaces the context dialer
+// of the dial options.
+func WithTargetPolicy(policy *TargetPolicy) ProxyOption {
+	return func(o *proxyOptions) {
+		o.policy = policy
+	}
+}
+
 func NewProxy(opts ...ProxyOption) *Proxy {
 	options := proxyOptions{
 		log:                   slog.New(slog.NewTextHandler(os.Stdout, nil)),
@@ -110,57 +194,139 @@ func NewProxy(opts ...ProxyOption) *Proxy {
 			grpc.WithBlock(),
 			grpc.WithTransportCredentials(insecure.NewCredentials()),
 		},
+		upgrader: &websocket.Upgrader{},
+		source:   ReflectionSource,
 	}
 	for _, o := range opts {
 		o(&options)
 	}
 	encoding.Register(options.marshaler, options.unmarshaler, options.log)
-	return &Proxy{
-		opts: options,
+	ctx, cancel := context.WithCancel(context.Background())
+	p := &Proxy{
+		opts:   options,
+		ctx:    ctx,
+		cancel: cancel,
+	}
+	if len(options.targets) > 0 {
+		p.dialTargets()
 	}
+	if options.idleTTL > 0 {
+		go p.evictIdle(ctx)
+	}
+	return p
 }
 
+// Client returns the client of target, dialing it on first use. Concurrent first calls share
+// one dial. The client is not held, unless the target is pinned by WithTargets it may be closed
+// at any time by WithClientIdleTTL, WithMaxClients or Close. Use AcquireClient to hold it.
 func (p *Proxy) Client(ctx context.Context, target string) (*ReflectClient, error) {
-	client, ok := p.srv.Load(target)
-	if ok {
-		return client.(*ReflectClient), nil
-	}
-	c, err := NewReflectClient(ctx, target, p.opts.log, p.opts.grpcOpts)
+	c, release, err := p.AcquireClient(ctx, target)
 	if err != nil {
 		return nil, err
 	}
-	p.srv.Store(target, c)
+	release()
 	return c, nil
 }
 
+// AcquireClient is Client with the client held, it is not evicted until release is called.
+// Close still closes it.
+func (p *Proxy) AcquireClient(ctx context.Context, target string) (*ReflectClient, func(), error) {
+	e, err := p.acquire(ctx, target)
+	if err != nil {
+		return nil, nil, err
+	}
+	var once sync.Once
+	return e.client, func() { once.Do(func() { p.release(e) }) }, nil
+}
+
+func (p *Proxy) newClient(ctx context.Context, target string) (*ReflectClient, error) {
+	address, grpcOpts := target, p.opts.grpcOpts
+	opts := append([]ClientOption{WithSource(p.opts.source)}, p.opts.clientOpts...)
+	if p.opts.registry != nil {
+		config, ok := p.opts.registry.Target(target)
+		if !ok {
+			return nil, fmt.Errorf("unknown target %s", target)
+		}
+		dialOpts, err := config.dialOptions()
+		if err != nil {
+			return nil, err
+		}
+		address = config.Address
+		grpcOpts = append(grpcOpts[:len(grpcOpts):len(grpcOpts)], dialOpts...)
+		opts = append(opts, WithName(target))
+		opts = append(opts, config.clientOptions()...)
+	}
+	if p.opts.targetOpts != nil {
+		opts = append(opts, p.opts.targetOpts(target)...)
+	}
+	if err := p.opts.policy.Check(ctx, address); err != nil {
+		return nil, err
+	}
+	if opt := p.opts.policy.dialOption(address); opt != nil {
+		grpcOpts = append(grpcOpts[:len(grpcOpts):len(grpcOpts)], opt)
+	}
+	if len(p.opts.targets) > 0 {
+		opts = append(opts, func(o *clientOptions) {
+			o.onUpdate = p.rebuildUnified
+		})
+	}
+	return NewReflectClient(ctx, address, p.opts.log, grpcOpts, opts...)
+}
+
+// Services reports the service status of every target dialed so far.
+func (p *Proxy) Services() map[string][]ServiceStatus {
+	status := make(map[string][]ServiceStatus)
+	p.srv.Range(func(key, value any) bool {
+		status[key.(string)] = value.(*clientEntry).client.Services()
+		return true
+	})
+	return status
+}
+
 func (p *Proxy) Handler() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		ctx, cancel := context.WithTimeout(r.Context(), p.opts.timeout)
 		defer cancel()
 
-		target, path := p.opts.pathExtract(r.URL.Path)
-		if target == "" || path == "" {
-			p.opts.log.Warn("path not found", "path", r.URL.Path)
-			w.WriteHeader(http.StatusNotFound)
+		routes, path, release, ok := p.routes(ctx, w, r)
+		if !ok {
 			return
 		}
+		defer release()
 
-		client, err := p.Client(ctx, target)
-		if err != nil {
-			p.opts.log.Warn("target not found", "target", target)
-			w.WriteHeader(http.StatusNotFound)
-			return
+		b, params := routes.MethodBinding(r.Method, path)
+		if b == nil {
+			get, getParams := routes.MethodBinding(http.MethodGet, path)
+			if r.Method == http.MethodHead && isHeadable(get) {
+				// HEAD is served by the GET route, the server drops the body
+				b, params = get, getParams
+			} else {
+				p.serveUnmatched(w, r, routes, path, isHeadable(get))
+				return
+			}
+		}
+		client := b.client
+		if client.opts.callTimeout > 0 {
+			var cancelCall context.CancelFunc
+			ctx, cancelCall = context.WithTimeout(r.Context(), client.opts.callTimeout)
+			defer cancelCall()
 		}
 
-		md, params := client.MethodParams(r.Method, path)
-		if md == nil {
-			p.opts.log.Warn("path not found", "path", r.URL.Path)
-			w.WriteHeader(http.StatusNotFound)
+		md := b.Method
+		switch {
+		case md.IsServerStreaming() && !md.IsClientStreaming():
+			p.serveServerStream(w, r, client, b, params)
+			return
+		case md.IsClientStreaming() && !md.IsServerStreaming():
+			p.serveClientStream(w, r, client, b, params)
+			return
+		case md.IsClientStreaming() && md.IsServerStreaming():
+			p.serveBidiStream(w, r, client, b, params)
 			return
 		}
 
 		msg := dynamic.NewMessage(md.GetInputType())
-		if err = RequestEncode(r, msg, params); err != nil {
+		if err := RequestEncodeBody(r, msg, params, b.Body); err != nil {
 			p.opts.log.Error("request encode", "err", err)
 			p.opts.errDecoder(w, err)
 			return
@@ -174,14 +340,9 @@ func (p *Proxy) Handler() http.HandlerFunc {
 			return
 		}
 
-		h := p.HeadersFromMetadata(header)
-		for k, vs := range h {
-			for _, v := range vs {
-				w.Header().Add(k, v)
-			}
-		}
+		p.writeHeader(w, header)
 
-		if err = ResponseDecode(r, w, resp); err != nil {
+		if err = ResponseDecodeField(r, w, resp, b.ResponseBody); err != nil {
 			p.opts.log.Error("response decode", "err", err)
 			p.opts.errDecoder(w, err)
 			return
@@ -191,6 +352,90 @@ func (p *Proxy) Handler() http.HandlerFunc {
 	}
 }
 
+// routes returns the routes serving r and the path to match, the routes of the target in the
+// path or the unified routes of all targets. It replies with 404 when there are none. release
+// must be called when the request is done.
+func (p *Proxy) routes(ctx context.Context, w http.ResponseWriter, r *http.Request) (routes routeMatcher, path string, release func(), ok bool) {
+	if len(p.opts.targets) > 0 {
+		// the targets are pinned, they are never evicted
+		return p.unified.Load(), r.URL.Path, func() {}, true
+	}
+	var target string
+	if p.opts.requestExtract != nil {
+		target, path = p.opts.requestExtract(r)
+	} else {
+		target, path = p.opts.pathExtract(r.URL.Path)
+	}
+	if target == "" || path == "" {
+		p.opts.log.Warn("path not found", "path", r.URL.Path)
+		w.WriteHeader(http.StatusNotFound)
+		return nil, "", nil, false
+	}
+
+	e, err := p.acquire(ctx, target)
+	if errors.Is(err, ErrTargetDenied) {
+		p.opts.log.Warn("target denied", "target", target, "remote_addr", r.RemoteAddr, "err", err)
+		w.WriteHeader(http.StatusForbidden)
+		return nil, "", nil, false
+	}
+	if err != nil {
+		p.opts.log.Warn("target not found", "target", target)
+		w.WriteHeader(http.StatusNotFound)
+		return nil, "", nil, false
+	}
+	return e.client, path, func() { p.release(e) }, true
+}
+
+// serveUnmatched answers a request with no route for its method, 405 when the path has routes
+// under other methods, 204 to OPTIONS and 404 otherwise.
+func (p *Proxy) serveUnmatched(w http.ResponseWriter, r *http.Request, routes routeMatcher, path string, head bool) {
+	methods := routes.AllowedMethods(path)
+	if len(methods) == 0 {
+		p.opts.log.Warn("path not found", "path", r.URL.Path)
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Allow", allowHeader(methods, head))
+	if r.Method == http.MethodOptions {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	p.opts.log.Warn("method not allowed", "method", r.Method, "path", r.URL.Path)
+	w.WriteHeader(http.StatusMethodNotAllowed)
+}
+
+// isHeadable reports whether a HEAD request can be served by the GET binding b.
+func isHeadable(b *Binding) bool {
+	return b != nil && b.Body == "" && !b.Method.IsClientStreaming() && !b.Method.IsServerStreaming()
+}
+
+// allowHeader lists methods, plus the HEAD and OPTIONS served without a route of their own.
+func allowHeader(methods []string, head bool) string {
+	set := make(map[string]bool)
+	for _, m := range methods {
+		set[m] = true
+	}
+	if head {
+		set[http.MethodHead] = true
+	}
+	set[http.MethodOptions] = true
+	allow := make([]string, 0, len(set))
+	for m := range set {
+		allow = append(allow, m)
+	}
+	sort.Strings(allow)
+	return strings.Join(allow, ", ")
+}
+
+func (p *Proxy) writeHeader(w http.ResponseWriter, md metadata.MD) {
+	h := p.HeadersFromMetadata(md)
+	for k, vs := range h {
+		for _, v := range vs {
+			w.Header().Add(k, v)
+		}
+	}
+}
+
 func (p *Proxy) metadataFromHeaders(raw map[string][]string) metadata.MD {
 	md := make(map[string][]string)
 	for k, v := range raw {
@@ -222,6 +467,33 @@ func DefaultHeaderMatcher(key string) (string, bool) {
 	return fmt.Sprintf("%s%s", runtime.MetadataHeaderPrefix, key), true
 }
 
+// HostExtract takes the target from the Host header with suffix trimmed, so with the suffix
+// ".api.example.com" books.api.example.com is served by the target "books". Hosts without
+// the suffix extract no target. The whole path is routed. The target is a bare alias with no
+// port, unlike DefaultPathExtract it adds no :50051, so combine it with WithRegistry.
+func HostExtract(suffix string) RequestExtractFunc {
+	return func(r *http.Request) (string, string) {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		host = strings.ToLower(host)
+		target, ok := strings.CutSuffix(host, strings.ToLower(suffix))
+		if !ok || target == "" {
+			return "", ""
+		}
+		return target, r.URL.Path
+	}
+}
+
+// HeaderExtract takes the target from the request header name, such as X-Target.
+// The whole path is routed. Clients choose the target, so combine it with WithRegistry.
+func HeaderExtract(name string) RequestExtractFunc {
+	return func(r *http.Request) (string, string) {
+		return r.Header.Get(name), r.URL.Path
+	}
+}
+
 // DefaultPathExtract 格式：/target/route*
 func DefaultPathExtract(path string) (string, string) {
 	parts := strings.Split(path, "/")
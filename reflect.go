@@ -2,14 +2,21 @@ package dynamic_proxy
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"io/fs"
 	"log/slog"
 	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
+	protov1 "github.com/golang/protobuf/proto"
 	"github.com/jhump/protoreflect/desc"
 	"github.com/jhump/protoreflect/dynamic"
 	"github.com/jhump/protoreflect/dynamic/grpcdynamic"
-	"github.com/jhump/protoreflect/grpcreflect"
 	"google.golang.org/genproto/googleapis/api/annotations"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/connectivity"
@@ -18,110 +25,568 @@ import (
 )
 
 type ReflectClient struct {
-	log    *slog.Logger
+	log  *slog.Logger
+	opts clientOptions
+	// target names the client, see WithName
+	target string
+	// ready is closed once conn, stub and source are set, under connMu
+	connMu sync.Mutex
+	ready  chan struct{}
 	conn   *grpc.ClientConn
 	stub   grpcdynamic.Stub
-	cancel context.CancelFunc
-	router Router
+	source DescriptorSource
+	// ctx is done once the client is closed
+	ctx      context.Context
+	cancel   context.CancelFunc
+	updateMu sync.Mutex
+	// table is an immutable snapshot, reloads publish a new one instead of changing it
+	table atomic.Pointer[routeTable]
+	// retry wakes the retry loop when services failed to resolve
+	retry chan struct{}
 }
 
-func NewReflectClient(ctx context.Context, target string, log *slog.Logger, opts []grpc.DialOption) (*ReflectClient, error) {
-	conn, err := grpc.DialContext(ctx, target, opts...)
-	if err != nil {
-		return nil, fmt.Errorf("failed to create grpc client: %v", err)
+const (
+	retryMinBackoff = time.Second
+	retryMaxBackoff = time.Minute
+)
+
+type ClientOption func(*clientOptions)
+
+type clientOptions struct {
+	source          DescriptorSourceFunc
+	watchInterval   time.Duration
+	pollInterval    time.Duration
+	cacheDir        string
+	reflectTimeout  time.Duration
+	reflectAttempts int
+	reflectBackoff  time.Duration
+	reflectMD       metadata.MD
+	reflectCallOpts []grpc.CallOption
+	strictRoutes    bool
+	services        map[string]bool
+	callTimeout     time.Duration
+	name            string
+	// onUpdate is called after a new table is published
+	onUpdate func()
+}
+
+// WithSource sets where the client resolves its services from, gRPC reflection by default.
+func WithSource(f DescriptorSourceFunc) ClientOption {
+	return func(o *clientOptions) {
+		o.source = f
+	}
+}
+
+// WithWatchInterval sets how often file based descriptor sources are checked for changes,
+// 2s by default. A d of 0 or less keeps the default.
+func WithWatchInterval(d time.Duration) ClientOption {
+	return func(o *clientOptions) {
+		if d > 0 {
+			o.watchInterval = d
+		}
+	}
+}
+
+// WithPollInterval re-lists the services every d and rebuilds the router when the descriptors
+// changed, 0 disables polling.
+func WithPollInterval(d time.Duration) ClientOption {
+	return func(o *clientOptions) {
+		o.pollInterval = d
+	}
+}
+
+// WithCacheDir caches the last resolved descriptors of the target in dir. When a cache exists,
+// routes are served from it right away while the target is dialed in the background.
+func WithCacheDir(dir string) ClientOption {
+	return func(o *clientOptions) {
+		o.cacheDir = dir
+	}
+}
+
+// WithReflectionTimeout bounds one listing and resolving of the target's services, 10s by default.
+func WithReflectionTimeout(d time.Duration) ClientOption {
+	return func(o *clientOptions) {
+		o.reflectTimeout = d
+	}
+}
+
+// WithReflectionRetry makes up to attempts tries to list the services, waiting backoff after the
+// first failure and doubling it after each next one. By default 3 attempts starting at 500ms.
+func WithReflectionRetry(attempts int, backoff time.Duration) ClientOption {
+	return func(o *clientOptions) {
+		o.reflectAttempts = attempts
+		o.reflectBackoff = backoff
+	}
+}
+
+// WithReflectionMetadata sends md with the reflection calls, such as an authorization header.
+func WithReflectionMetadata(md metadata.MD) ClientOption {
+	return func(o *clientOptions) {
+		o.reflectMD = md
+	}
+}
+
+// WithReflectionCallOptions adds opts to the reflection calls, for example
+// grpc.PerRPCCredentials to authenticate them.
+func WithReflectionCallOptions(opts ...grpc.CallOption) ClientOption {
+	return func(o *clientOptions) {
+		o.reflectCallOpts = opts
+	}
+}
+
+// WithStrictRoutes fails the reload when two routes conflict, the last router is kept. By default
+// the route of the service listed first wins and the conflict is logged.
+func WithStrictRoutes() ClientOption {
+	return func(o *clientOptions) {
+		o.strictRoutes = true
+	}
+}
+
+// WithServices only exposes the listed services over http, the others get no routes.
+func WithServices(names ...string) ClientOption {
+	return func(o *clientOptions) {
+		o.services = make(map[string]bool)
+		for _, name := range names {
+			o.services[name] = true
+		}
+	}
+}
+
+// WithCallTimeout bounds the unary calls to the target instead of the proxy timeout.
+func WithCallTimeout(d time.Duration) ClientOption {
+	return func(o *clientOptions) {
+		o.callTimeout = d
+	}
+}
+
+// WithName names the client in logs and cache files, the dialed target by default.
+func WithName(name string) ClientOption {
+	return func(o *clientOptions) {
+		o.name = name
+	}
+}
+
+// Binding is a method bound to an http rule.
+type Binding struct {
+	Method *desc.MethodDescriptor
+	// Body is the request field the http body maps to, "*" for the whole request and "" for no body.
+	Body string
+	// ResponseBody is the response field written as the http body, "" for the whole response.
+	ResponseBody string
+	// client is the client of the target serving the method
+	client *ReflectClient
+}
+
+func NewReflectClient(ctx context.Context, target string, log *slog.Logger, opts []grpc.DialOption, copts ...ClientOption) (*ReflectClient, error) {
+	options := clientOptions{
+		source:          ReflectionSource,
+		watchInterval:   time.Second * 2,
+		reflectTimeout:  time.Second * 10,
+		reflectAttempts: 3,
+		reflectBackoff:  time.Millisecond * 500,
+	}
+	for _, o := range copts {
+		o(&options)
+	}
+	if options.name == "" {
+		options.name = target
 	}
-	stub := grpcdynamic.NewStub(conn)
 	c, cancel := context.WithCancel(context.Background())
 	g := &ReflectClient{
 		log:    log,
-		conn:   conn,
-		stub:   stub,
+		opts:   options,
+		target: options.name,
+		ready:  make(chan struct{}),
+		ctx:    c,
 		cancel: cancel,
+		retry:  make(chan struct{}, 1),
+	}
+	// with cached descriptors the routes are served right away and the target is dialed in the background
+	if g.opts.cacheDir != "" {
+		if err := g.loadCache(); err == nil {
+			go g.dial(c, target, opts)
+			return g, nil
+		} else if !errors.Is(err, fs.ErrNotExist) {
+			log.Warn("load descriptor cache fail", "target", g.target, "err", err)
+		}
+	}
+	conn, err := grpc.DialContext(ctx, target, opts...)
+	if err != nil {
+		cancel()
+		return nil, fmt.Errorf("failed to create grpc client: %v", err)
+	}
+	if err = g.connect(ctx, conn); err != nil {
+		cancel()
+		conn.Close()
+		return nil, err
 	}
-	g.watch(c)
 	return g, nil
 }
 
+// dial connects to target until it succeeds or ctx is done, routes are served from the cache meanwhile.
+func (c *ReflectClient) dial(ctx context.Context, target string, opts []grpc.DialOption) {
+	conn, err := grpc.DialContext(ctx, target, opts...)
+	if err != nil {
+		if ctx.Err() == nil {
+			c.log.Error("dial target fail", "target", target, "err", err)
+		}
+		return
+	}
+	if err = c.connect(ctx, conn); err != nil {
+		if c.ctx.Err() == nil {
+			c.log.Error("connect fail", "target", target, "err", err)
+		}
+		conn.Close()
+	}
+}
+
+// connect serves the target over conn, ctx bounds the first listing of its services.
+func (c *ReflectClient) connect(ctx context.Context, conn *grpc.ClientConn) error {
+	var sourceConn grpc.ClientConnInterface = conn
+	if len(c.opts.reflectCallOpts) > 0 {
+		sourceConn = &callOptionConn{ClientConnInterface: conn, opts: c.opts.reflectCallOpts}
+	}
+	source, err := c.opts.source(c.target, sourceConn)
+	if err != nil {
+		return fmt.Errorf("failed to create descriptor source: %v", err)
+	}
+	// a Close in between either sees the conn or keeps it from being set
+	c.connMu.Lock()
+	if err = c.ctx.Err(); err != nil {
+		c.connMu.Unlock()
+		return err
+	}
+	c.conn = conn
+	c.stub = grpcdynamic.NewStub(conn)
+	c.source = source
+	close(c.ready)
+	c.connMu.Unlock()
+	c.watch(ctx)
+	return nil
+}
+
+func (c *ReflectClient) connected() bool {
+	select {
+	case <-c.ready:
+		return true
+	default:
+		return false
+	}
+}
+
 func (c *ReflectClient) MethodParams(method, path string) (*desc.MethodDescriptor, map[string]string) {
-	params, extra, ok := c.router.Match(method, path)
-	if !ok {
+	b, params := c.MethodBinding(method, path)
+	if b == nil {
 		return nil, nil
 	}
-	if md, ok := extra.(*desc.MethodDescriptor); ok {
-		return md, params
-	}
-	return nil, nil
+	return b.Method, params
+}
+
+// MethodBinding returns the binding of the route matching the request and its path params.
+func (c *ReflectClient) MethodBinding(method, path string) (*Binding, map[string]string) {
+	return c.table.Load().MethodBinding(method, path)
+}
+
+// AllowedMethods returns the sorted http methods with a route matching path.
+func (c *ReflectClient) AllowedMethods(path string) []string {
+	return c.table.Load().AllowedMethods(path)
 }
 
 func (c *ReflectClient) Invoke(ctx context.Context, method *desc.MethodDescriptor, req *dynamic.Message) (*dynamic.Message, metadata.MD, error) {
 	if method.IsServerStreaming() || method.IsClientStreaming() {
 		return nil, nil, fmt.Errorf("failed to invoke stream")
 	}
+	if !c.connected() {
+		return nil, nil, errNotConnected
+	}
 	md := metadata.New(make(map[string]string))
 	res, err := c.stub.InvokeRpc(ctx, method, req, grpc.Header(&md))
 	if err != nil {
 		return nil, nil, err
 	}
-	dm := dynamic.NewMessage(method.GetOutputType())
-	if err = dm.ConvertFrom(res); err != nil {
-		return nil, nil, fmt.Errorf("conver output message error: %v", err)
+	dm, err := outputMessage(method, res)
+	if err != nil {
+		return nil, nil, err
 	}
 	return dm, md, nil
 }
 
+func (c *ReflectClient) InvokeServerStream(ctx context.Context, method *desc.MethodDescriptor, req *dynamic.Message) (*grpcdynamic.ServerStream, error) {
+	if !c.connected() {
+		return nil, errNotConnected
+	}
+	return c.stub.InvokeRpcServerStream(ctx, method, req)
+}
+
+func (c *ReflectClient) InvokeClientStream(ctx context.Context, method *desc.MethodDescriptor) (*grpcdynamic.ClientStream, error) {
+	if !c.connected() {
+		return nil, errNotConnected
+	}
+	return c.stub.InvokeRpcClientStream(ctx, method)
+}
+
+func (c *ReflectClient) InvokeBidiStream(ctx context.Context, method *desc.MethodDescriptor) (*grpcdynamic.BidiStream, error) {
+	if !c.connected() {
+		return nil, errNotConnected
+	}
+	return c.stub.InvokeRpcBidiStream(ctx, method)
+}
+
 func (c *ReflectClient) Close() error {
+	c.connMu.Lock()
 	c.cancel()
+	connected := c.connected()
+	c.connMu.Unlock()
+	if !connected {
+		return nil
+	}
 	return c.conn.Close()
 }
 
+func outputMessage(method *desc.MethodDescriptor, res protov1.Message) (*dynamic.Message, error) {
+	dm := dynamic.NewMessage(method.GetOutputType())
+	if err := dm.ConvertFrom(res); err != nil {
+		return nil, fmt.Errorf("conver output message error: %v", err)
+	}
+	return dm, nil
+}
+
 // https://github.com/googleapis/googleapis/blob/master/google/api/http.proto#L46
-func (c *ReflectClient) route() (Router, error) {
-	client := grpcreflect.NewClientAuto(context.Background(), c.conn)
-	services, err := client.ListServices()
+func (c *ReflectClient) route(ctx context.Context, source DescriptorSource) (*routeTable, error) {
+	services, err := source.ListServices(ctx)
 	if err != nil {
 		return nil, fmt.Errorf("failed to ListServices: %v", err)
 	}
-	router := NewRouter()
+	if c.opts.services != nil {
+		exposed := services[:0:0]
+		for _, srv := range services {
+			if c.opts.services[srv] {
+				exposed = append(exposed, srv)
+			}
+		}
+		services = exposed
+	}
+	// build in a stable order, so the same descriptors always produce the same table
+	sort.Strings(services)
+	table := newRouteTable()
+	table.services = services
+	var files []*desc.FileDescriptor
 	for _, srv := range services {
-		srvDesc, err := client.ResolveService(srv)
+		srvDesc, err := source.ResolveService(ctx, srv)
 		if err != nil {
-			return nil, fmt.Errorf("failed to ResolveService: %v", err)
+			// a broken service must not take down the routes of the others
+			c.log.Error("resolve service fail", "target", c.target, "service", srv, "err", err)
+			table.failed[srv] = fmt.Errorf("failed to ResolveService: %v", err)
+			continue
 		}
+		files = append(files, srvDesc.GetFile())
 		methods := srvDesc.GetMethods()
 		for _, method := range methods {
+			table.methods[method.GetFullyQualifiedName()] = true
 			opts := method.GetMethodOptions()
 			ext := proto.GetExtension(opts, annotations.E_Http)
 			httpOpt, ok := ext.(*annotations.HttpRule)
 			if !ok {
 				continue
 			}
-			switch (httpOpt.GetPattern()).(type) {
-			case *annotations.HttpRule_Get:
-				err = router.Add(http.MethodGet, httpOpt.GetGet(), method)
-			case *annotations.HttpRule_Put:
-				err = router.Add(http.MethodPut, httpOpt.GetPut(), method)
-			case *annotations.HttpRule_Post:
-				err = router.Add(http.MethodPost, httpOpt.GetPost(), method)
-			case *annotations.HttpRule_Delete:
-				err = router.Add(http.MethodDelete, httpOpt.GetDelete(), method)
-			case *annotations.HttpRule_Patch:
-				err = router.Add(http.MethodPatch, httpOpt.GetPatch(), method)
-			}
-			if err != nil {
-				c.log.Error("build route fail", "err", err)
-				continue
+			// additional bindings are not allowed to nest, so one level is enough
+			rules := append([]*annotations.HttpRule{httpOpt}, httpOpt.GetAdditionalBindings()...)
+			for _, rule := range rules {
+				rb, err := addRule(table.router, c, method, rule)
+				var conflict *ConflictError
+				if errors.As(err, &conflict) {
+					existing := ""
+					if b, ok := conflict.Extra.(*Binding); ok {
+						existing = b.Method.GetFullyQualifiedName()
+					}
+					c.log.Warn("route conflict", "target", c.target, "method", method.GetFullyQualifiedName(),
+						"existing_method", existing, "err", err)
+					table.conflicts = append(table.conflicts, err)
+					continue
+				}
+				if err != nil {
+					c.log.Error("build route fail", "method", method.GetFullyQualifiedName(), "err", err)
+					continue
+				}
+				if rb.binding != nil {
+					table.bindings = append(table.bindings, rb)
+					table.routes[rb.verb+" "+rb.path] = method.GetFullyQualifiedName()
+				}
 			}
 		}
 	}
-	return router, nil
+	if c.opts.strictRoutes && len(table.conflicts) > 0 {
+		return nil, fmt.Errorf("ambiguous routes: %w", errors.Join(table.conflicts...))
+	}
+	table.files = files
+	if table.sum, err = descriptorSum(files); err != nil {
+		return nil, err
+	}
+	return table, nil
+}
+
+// resolve builds the table from the client's source, retrying with backoff when the services
+// cannot be listed. Every try is bounded by the reflection timeout, all of them by ctx.
+func (c *ReflectClient) resolve(ctx context.Context) (*routeTable, error) {
+	backoff := c.opts.reflectBackoff
+	var err error
+	for attempt := 1; ; attempt++ {
+		var table *routeTable
+		table, err = c.resolveOnce(ctx)
+		if err == nil {
+			return table, nil
+		}
+		// conflicting routes are not going away by asking again
+		var conflict *ConflictError
+		if attempt >= c.opts.reflectAttempts || errors.As(err, &conflict) {
+			return nil, err
+		}
+		c.log.Warn("list services fail, retry", "target", c.target, "attempt", attempt, "backoff", backoff, "err", err)
+		select {
+		case <-ctx.Done():
+			return nil, fmt.Errorf("failed to list services: %v", ctx.Err())
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
 }
 
-func (c *ReflectClient) watch(ctx context.Context) {
-	router, err := c.route()
+func (c *ReflectClient) resolveOnce(ctx context.Context) (*routeTable, error) {
+	ctx, cancel := context.WithTimeout(ctx, c.opts.reflectTimeout)
+	defer cancel()
+	if c.opts.reflectMD.Len() > 0 {
+		ctx = metadata.NewOutgoingContext(ctx, c.opts.reflectMD)
+	}
+	return c.route(ctx, c.source)
+}
+
+// addRule registers rule on router for the client owner and returns the route it was bound to,
+// with a nil binding when the rule has no pattern.
+func addRule(router Router, owner *ReflectClient, method *desc.MethodDescriptor, rule *annotations.HttpRule) (routeBinding, error) {
+	var verb, path string
+	switch pattern := rule.GetPattern().(type) {
+	case *annotations.HttpRule_Get:
+		verb, path = http.MethodGet, pattern.Get
+	case *annotations.HttpRule_Put:
+		verb, path = http.MethodPut, pattern.Put
+	case *annotations.HttpRule_Post:
+		verb, path = http.MethodPost, pattern.Post
+	case *annotations.HttpRule_Delete:
+		verb, path = http.MethodDelete, pattern.Delete
+	case *annotations.HttpRule_Patch:
+		verb, path = http.MethodPatch, pattern.Patch
+	case *annotations.HttpRule_Custom:
+		verb, path = strings.ToUpper(pattern.Custom.GetKind()), pattern.Custom.GetPath()
+	default:
+		return routeBinding{}, nil
+	}
+	b := &Binding{
+		Method:       method,
+		Body:         rule.GetBody(),
+		ResponseBody: rule.GetResponseBody(),
+		client:       owner,
+	}
+	if err := router.Add(verb, path, b); err != nil {
+		return routeBinding{}, err
+	}
+	return routeBinding{verb: verb, path: path, binding: b}, nil
+}
+
+// update rebuilds the router and swaps it in when the descriptors changed, the previous router
+// is kept when the build fails. Requests already matched keep their binding, so nothing in
+// flight is dropped.
+func (c *ReflectClient) update(ctx context.Context) error {
+	c.updateMu.Lock()
+	defer c.updateMu.Unlock()
+	table, err := c.resolve(ctx)
 	if err != nil {
+		return err
+	}
+	if len(table.failed) > 0 {
+		select {
+		case c.retry <- struct{}{}:
+		default:
+		}
+	}
+	old := c.table.Load()
+	if old != nil && old.sum == table.sum && sameKeys(old.failed, table.failed) {
+		if old.cached {
+			c.publish(table)
+			c.log.Info("cached descriptors are up to date", "target", c.target)
+		}
+		return nil
+	}
+	c.publish(table)
+	c.logDiff(old, table)
+	if err = c.saveCache(table); err != nil {
+		c.log.Warn("save descriptor cache fail", "target", c.target, "err", err)
+	}
+	return nil
+}
+
+func (c *ReflectClient) publish(table *routeTable) {
+	c.table.Store(table)
+	if c.opts.onUpdate != nil {
+		c.opts.onUpdate()
+	}
+}
+
+func (c *ReflectClient) logDiff(old, table *routeTable) {
+	if old == nil {
+		old = newRouteTable()
+	}
+	addedMethods, removedMethods := diffKeys(old.methods, table.methods)
+	addedRoutes, removedRoutes := diffKeys(old.routes, table.routes)
+	failed, _ := diffKeys(nil, table.failed)
+	c.log.Info("update method", "target", c.target,
+		"methods_added", addedMethods, "methods_removed", removedMethods,
+		"routes_added", addedRoutes, "routes_removed", removedRoutes,
+		"services_failed", failed)
+}
+
+// Services reports every service of the target and whether it could be resolved.
+func (c *ReflectClient) Services() []ServiceStatus {
+	table := c.table.Load()
+	if table == nil {
+		return nil
+	}
+	status := make([]ServiceStatus, 0, len(table.services))
+	for _, name := range table.services {
+		status = append(status, ServiceStatus{Name: name, Err: table.failed[name]})
+	}
+	return status
+}
+
+// watch builds the first router within ctx and keeps it up to date until the client is closed.
+func (c *ReflectClient) watch(ctx context.Context) {
+	if err := c.update(ctx); err != nil {
 		c.log.Error("update method fail", "err", err)
+		if c.table.Load() == nil {
+			if err = c.loadCache(); err != nil && c.opts.cacheDir != "" {
+				c.log.Warn("load descriptor cache fail", "target", c.target, "err", err)
+			}
+		}
+		// keep trying in the background, the first router was only given until ctx is done
+		select {
+		case c.retry <- struct{}{}:
+		default:
+		}
+	}
+	ctx = c.ctx
+	if src, ok := c.source.(WatchableSource); ok {
+		go src.Watch(ctx, c.opts.watchInterval, func(err error) {
+			if err == nil {
+				err = c.update(ctx)
+			}
+			if err != nil {
+				c.log.Error("reload descriptors fail, keep the last router", "target", c.target, "err", err)
+			}
+		})
 	}
-	c.router = router
+	if c.opts.pollInterval > 0 {
+		go c.poll(ctx)
+	}
+	go c.retryFailed(ctx)
 	go func() {
 		//defer func() {
 		//	if rec := recover(); rec != nil {
@@ -138,13 +603,51 @@ func (c *ReflectClient) watch(ctx context.Context) {
 			if c.conn.GetState() != connectivity.Ready {
 				continue
 			}
-			router, err = c.route()
-			if err != nil {
+			if err := c.update(ctx); err != nil {
 				c.log.Error("update method fail", "err", err)
-				continue
 			}
-			c.router = router
-			c.log.Info("update method", "target", c.conn.Target())
 		}
 	}()
 }
+
+// poll re-lists the services every poll interval, it catches descriptors changed by a rolling
+// deploy that never drops the connection.
+func (c *ReflectClient) poll(ctx context.Context) {
+	ticker := time.NewTicker(c.opts.pollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if err := c.update(ctx); err != nil {
+			c.log.Error("update method fail", "err", err)
+		}
+	}
+}
+
+// retryFailed rebuilds the router with exponential backoff while there is none yet or some
+// services fail to resolve.
+func (c *ReflectClient) retryFailed(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-c.retry:
+		}
+		for backoff := retryMinBackoff; ; backoff = min(backoff*2, retryMaxBackoff) {
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(backoff):
+			}
+			if err := c.update(ctx); err != nil {
+				c.log.Error("update method fail", "err", err)
+			}
+			if table := c.table.Load(); table != nil && len(table.failed) == 0 {
+				break
+			}
+		}
+	}
+}
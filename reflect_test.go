@@ -0,0 +1,150 @@
+package dynamic_proxy
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/jhump/protoreflect/desc"
+)
+
+const libraryProto = `syntax = "proto3";
+package library;
+import "google/api/annotations.proto";
+message Book {
+  string id = 1;
+}
+message ListBooksResponse {
+  repeated Book books = 1;
+}
+service Library {
+  rpc GetBook(Book) returns (Book) {
+    option (google.api.http) = {get: "/v1/books/{id}"};
+  }
+%s
+}
+`
+
+const listBooksRPC = `  rpc ListBooks(Book) returns (ListBooksResponse) {
+    option (google.api.http) = {get: "/v1/books"};
+  }`
+
+func compileServices(t testing.TB, src string) map[string]*desc.ServiceDescriptor {
+	t.Helper()
+	dir := t.TempDir()
+	file := filepath.Join(dir, "library.proto")
+	if err := os.WriteFile(file, []byte(src), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	set, err := compileProtos(dir, []string{file})
+	if err != nil {
+		t.Fatal(err)
+	}
+	services, err := servicesFromSet(set)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return services
+}
+
+// flipSource switches between its versions on every listing, so every update publishes a new table.
+type flipSource struct {
+	versions []map[string]*desc.ServiceDescriptor
+	n        atomic.Int64
+}
+
+func (s *flipSource) current() map[string]*desc.ServiceDescriptor {
+	return s.versions[s.n.Load()%int64(len(s.versions))]
+}
+
+func (s *flipSource) ListServices(context.Context) ([]string, error) {
+	s.n.Add(1)
+	var names []string
+	for name := range s.current() {
+		names = append(names, name)
+	}
+	return names, nil
+}
+
+func (s *flipSource) ResolveService(_ context.Context, name string) (*desc.ServiceDescriptor, error) {
+	return s.current()[name], nil
+}
+
+func TestReloadRace(t *testing.T) {
+	src := &flipSource{versions: []map[string]*desc.ServiceDescriptor{
+		compileServices(t, fmt.Sprintf(libraryProto, "")),
+		compileServices(t, fmt.Sprintf(libraryProto, listBooksRPC)),
+	}}
+	c := &ReflectClient{
+		log:    slog.New(slog.NewTextHandler(io.Discard, nil)),
+		opts:   clientOptions{reflectTimeout: time.Second, reflectAttempts: 1},
+		target: "library",
+		ready:  make(chan struct{}),
+		retry:  make(chan struct{}, 1),
+		source: src,
+	}
+	if err := c.update(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	var (
+		wg       sync.WaitGroup
+		done     = make(chan struct{})
+		reloaded atomic.Int64
+	)
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				if err := c.update(context.Background()); err != nil {
+					t.Error(err)
+					return
+				}
+				reloaded.Add(1)
+			}
+		}()
+	}
+	var readers sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		readers.Add(1)
+		go func() {
+			defer readers.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				md, params := c.MethodParams("GET", "/v1/books/1")
+				if md == nil || md.GetName() != "GetBook" || params["id"] != "1" {
+					t.Errorf("match /v1/books/1: got %v %v", md, params)
+					return
+				}
+				if methods := c.AllowedMethods("/v1/books/1"); !reflect.DeepEqual(methods, []string{"GET"}) {
+					t.Errorf("allowed methods of /v1/books/1: got %v", methods)
+					return
+				}
+				// ListBooks comes and goes, but a match is always bound to it
+				if b, _ := c.MethodBinding("GET", "/v1/books"); b != nil && b.Method.GetName() != "ListBooks" {
+					t.Errorf("match /v1/books: got %v", b.Method.GetName())
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	close(done)
+	readers.Wait()
+	if reloaded.Load() != 200 {
+		t.Errorf("reloaded %d times, want 200", reloaded.Load())
+	}
+}
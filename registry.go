@@ -0,0 +1,196 @@
+package dynamic_proxy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+)
+
+// Registry maps target aliases to their address and settings, requests can only reach the
+// targets it lists.
+type Registry struct {
+	targets map[string]TargetConfig
+}
+
+// RegistryConfig is the JSON file read by LoadRegistry.
+type RegistryConfig struct {
+	Targets []TargetConfig `json:"targets"`
+}
+
+// TargetConfig configures the target served under Alias.
+type TargetConfig struct {
+	Alias   string `json:"alias"`
+	Address string `json:"address"`
+	// Timeout bounds every unary call to the target, the proxy timeout by default.
+	Timeout Duration          `json:"timeout,omitempty"`
+	TLS     *TLSConfig        `json:"tls,omitempty"`
+	Source  *DescriptorConfig `json:"source,omitempty"`
+	// Services lists the services exposed over http, all of them when empty.
+	Services []string `json:"services,omitempty"`
+}
+
+// TLSConfig enables TLS for the connection to a target, the proxy dial options apply when it is not set.
+type TLSConfig struct {
+	// CAFile verifies the server certificate, the system roots are used when empty.
+	CAFile string `json:"ca_file,omitempty"`
+	// CertFile and KeyFile are the client certificate for mutual TLS.
+	CertFile           string `json:"cert_file,omitempty"`
+	KeyFile            string `json:"key_file,omitempty"`
+	ServerName         string `json:"server_name,omitempty"`
+	InsecureSkipVerify bool   `json:"insecure_skip_verify,omitempty"`
+}
+
+// DescriptorConfig selects the descriptor source of a target.
+type DescriptorConfig struct {
+	// Type is "reflection" (the default), "protoset" or "proto".
+	Type string `json:"type"`
+	// Paths are the protoset files or directories, or the single directory of .proto files.
+	Paths []string `json:"paths,omitempty"`
+}
+
+// Duration is a time.Duration written as a string such as "5s" in JSON.
+type Duration time.Duration
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return fmt.Errorf("duration must be a string: %v", err)
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// LoadRegistry reads a registry from a JSON file.
+func LoadRegistry(path string) (*Registry, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read registry: %v", err)
+	}
+	var config RegistryConfig
+	if err = json.Unmarshal(b, &config); err != nil {
+		return nil, fmt.Errorf("failed to parse registry %s: %v", path, err)
+	}
+	return NewRegistry(config.Targets...)
+}
+
+func NewRegistry(targets ...TargetConfig) (*Registry, error) {
+	r := &Registry{targets: make(map[string]TargetConfig)}
+	for _, t := range targets {
+		if t.Alias == "" || strings.Contains(t.Alias, "/") {
+			return nil, fmt.Errorf("invalid target alias %q", t.Alias)
+		}
+		if t.Address == "" {
+			return nil, fmt.Errorf("target %s has no address", t.Alias)
+		}
+		if _, ok := r.targets[t.Alias]; ok {
+			return nil, fmt.Errorf("duplicate target alias %s", t.Alias)
+		}
+		if t.Source != nil {
+			if _, err := t.Source.sourceFunc(); err != nil {
+				return nil, fmt.Errorf("target %s: %v", t.Alias, err)
+			}
+		}
+		r.targets[t.Alias] = t
+	}
+	return r, nil
+}
+
+// Target returns the config of alias.
+func (r *Registry) Target(alias string) (TargetConfig, bool) {
+	t, ok := r.targets[alias]
+	return t, ok
+}
+
+// PathExtract is a PathExtractFunc taking the first path segment as the alias of a target,
+// an unknown alias extracts no target.
+func (r *Registry) PathExtract(path string) (string, string) {
+	parts := strings.SplitN(path, "/", 3)
+	if len(parts) < 3 {
+		return "", ""
+	}
+	if _, ok := r.targets[parts[1]]; !ok {
+		return "", ""
+	}
+	return parts[1], "/" + parts[2]
+}
+
+// dialOptions returns the dial options of the target on top of the proxy ones.
+func (t TargetConfig) dialOptions() ([]grpc.DialOption, error) {
+	if t.TLS == nil {
+		return nil, nil
+	}
+	config := &tls.Config{
+		ServerName:         t.TLS.ServerName,
+		InsecureSkipVerify: t.TLS.InsecureSkipVerify,
+	}
+	if t.TLS.CAFile != "" {
+		b, err := os.ReadFile(t.TLS.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read ca file: %v", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(b) {
+			return nil, fmt.Errorf("no certificate found in %s", t.TLS.CAFile)
+		}
+		config.RootCAs = pool
+	}
+	if t.TLS.CertFile != "" || t.TLS.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(t.TLS.CertFile, t.TLS.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load client certificate: %v", err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return []grpc.DialOption{grpc.WithTransportCredentials(credentials.NewTLS(config))}, nil
+}
+
+// clientOptions returns the client options of the target, applied after the proxy ones.
+func (t TargetConfig) clientOptions() []ClientOption {
+	var opts []ClientOption
+	if t.Source != nil {
+		// validated by NewRegistry
+		f, _ := t.Source.sourceFunc()
+		opts = append(opts, WithSource(f))
+	}
+	if len(t.Services) > 0 {
+		opts = append(opts, WithServices(t.Services...))
+	}
+	if t.Timeout > 0 {
+		opts = append(opts, WithCallTimeout(time.Duration(t.Timeout)))
+	}
+	return opts
+}
+
+func (c *DescriptorConfig) sourceFunc() (DescriptorSourceFunc, error) {
+	switch c.Type {
+	case "", "reflection":
+		return ReflectionSource, nil
+	case "protoset":
+		if len(c.Paths) == 0 {
+			return nil, fmt.Errorf("protoset source has no paths")
+		}
+		return ProtosetSource(c.Paths...), nil
+	case "proto":
+		if len(c.Paths) != 1 {
+			return nil, fmt.Errorf("proto source needs exactly one directory")
+		}
+		return ProtoSource(c.Paths[0]), nil
+	default:
+		return nil, fmt.Errorf("unknown descriptor source %q", c.Type)
+	}
+}
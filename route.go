@@ -1,10 +1,13 @@
 package dynamic_proxy
 
 import (
+	"fmt"
 	"regexp"
+	"sort"
 	"strings"
 
 	"github.com/grpc-ecosystem/grpc-gateway/v2/runtime"
+	"github.com/grpc-ecosystem/grpc-gateway/v2/utilities"
 	"github.com/lemon-1997/dynamic-proxy/httprule"
 )
 
@@ -13,23 +16,104 @@ var encodedPathSplitter = regexp.MustCompile("(/|%2F)")
 type Router interface {
 	Add(method, path string, extra interface{}) error
 	Match(method, path string) (map[string]string, interface{}, bool)
+	// Methods returns the sorted methods with a route matching path.
+	Methods(path string) []string
 }
 
 type Pattern struct {
 	runtime.Pattern
 	extra interface{}
+	// tail holds the segments after "**", "*" for a variable
+	tail []string
+}
+
+// ConflictError is returned by Router.Add when a route matches exactly the requests of one
+// added before, such as /v1/{name} and /v1/{id}. The route added first is kept.
+type ConflictError struct {
+	Method string
+	Path   string
+	// Existing is the template of the route added before and Extra its extra.
+	Existing string
+	Extra    interface{}
+}
+
+func (e *ConflictError) Error() string {
+	return fmt.Sprintf("route %s %s conflicts with %s", e.Method, e.Path, e.Existing)
+}
+
+// node is a trie node keyed by path segment. Patterns are stored at the node reached by their
+// segments up to the first "**", the rest of the pattern is checked by MatchAndEscape.
+type node struct {
+	literals map[string]*node
+	wildcard *node
+	// deep holds the patterns with a "**" segment at this depth
+	deep []*Pattern
+	// leaves holds the patterns ending at this node
+	leaves []*Pattern
+}
+
+func newNode() *node {
+	return &node{literals: make(map[string]*node)}
 }
 
 type httpRouter struct {
 	unescapeMode runtime.UnescapingMode
-	patterns     map[string][]Pattern
+	trees        map[string]*node
+	// shapes holds the pattern added for each "METHOD shape", see templateShape
+	shapes map[string]*Pattern
 }
 
 func NewRouter() Router {
 	return &httpRouter{
 		unescapeMode: runtime.UnescapingModeDefault,
-		patterns:     make(map[string][]Pattern),
+		trees:        make(map[string]*node),
+		shapes:       make(map[string]*Pattern),
+	}
+}
+
+// templateShape is the template with variable names dropped, two templates of the same shape
+// match the same paths. It also returns the segments after "**".
+func templateShape(tmpl httprule.Template) (string, []string) {
+	var b strings.Builder
+	var tail []string
+	deep := false
+	for i := 0; i < len(tmpl.OpCodes); i += 2 {
+		var seg string
+		switch utilities.OpCode(tmpl.OpCodes[i]) {
+		case utilities.OpLitPush:
+			seg = tmpl.Pool[tmpl.OpCodes[i+1]]
+		case utilities.OpPush:
+			seg = "*"
+		case utilities.OpPushM:
+			b.WriteString("/**")
+			deep = true
+			continue
+		default:
+			continue
+		}
+		b.WriteString("/" + seg)
+		if deep {
+			tail = append(tail, seg)
+		}
+	}
+	if tmpl.Verb != "" {
+		b.WriteString(":" + tmpl.Verb)
+	}
+	return b.String(), tail
+}
+
+// moreSpecific orders the patterns stored at one node: the longer tail after "**" first, then
+// literal segments before variables from left to right, then a verb before none.
+func moreSpecific(a, b *Pattern) bool {
+	if len(a.tail) != len(b.tail) {
+		return len(a.tail) > len(b.tail)
+	}
+	for i := range a.tail {
+		if (a.tail[i] == "*") != (b.tail[i] == "*") {
+			return b.tail[i] == "*"
+		}
 	}
+	return a.Verb() != "" && b.Verb() == ""
 }
 
 func (r *httpRouter) Add(method, path string, extra interface{}) error {
@@ -42,9 +126,49 @@ func (r *httpRouter) Add(method, path string, extra interface{}) error {
 	if err != nil {
 		return err
 	}
-	r.patterns[method] = append(r.patterns[method], Pattern{
+	shape, tail := templateShape(tmpl)
+	if prev, ok := r.shapes[method+" "+shape]; ok {
+		return &ConflictError{Method: method, Path: path, Existing: prev.String(), Extra: prev.extra}
+	}
+	item := &Pattern{
 		Pattern: p,
 		extra:   extra,
+		tail:    tail,
+	}
+	r.shapes[method+" "+shape] = item
+	n, ok := r.trees[method]
+	if !ok {
+		n = newNode()
+		r.trees[method] = n
+	}
+	// op codes come in (code, operand) pairs, only the pushes consume a path segment
+	for i := 0; i < len(tmpl.OpCodes); i += 2 {
+		switch utilities.OpCode(tmpl.OpCodes[i]) {
+		case utilities.OpLitPush:
+			lit := tmpl.Pool[tmpl.OpCodes[i+1]]
+			child, ok := n.literals[lit]
+			if !ok {
+				child = newNode()
+				n.literals[lit] = child
+			}
+			n = child
+		case utilities.OpPush:
+			if n.wildcard == nil {
+				n.wildcard = newNode()
+			}
+			n = n.wildcard
+		case utilities.OpPushM:
+			n.deep = append(n.deep, item)
+			sort.SliceStable(n.deep, func(i, j int) bool {
+				return moreSpecific(n.deep[i], n.deep[j])
+			})
+			return nil
+		}
+	}
+	// a pattern with a verb is tried first, so {id}:watch is not taken as the id
+	n.leaves = append(n.leaves, item)
+	sort.SliceStable(n.leaves, func(i, j int) bool {
+		return moreSpecific(n.leaves[i], n.leaves[j])
 	})
 	return nil
 }
@@ -56,40 +180,101 @@ func (r *httpRouter) Match(method, path string) (map[string]string, interface{},
 	if !strings.HasPrefix(path, "/") {
 		return nil, nil, false
 	}
+	root, ok := r.trees[method]
+	if !ok {
+		return nil, nil, false
+	}
 	var pathComponents []string
-	pathComponents = strings.Split(path[1:], "/")
-
 	if r.unescapeMode == runtime.UnescapingModeAllCharacters {
 		pathComponents = encodedPathSplitter.Split(path[1:], -1)
 	} else {
 		pathComponents = strings.Split(path[1:], "/")
 	}
 
-	lastPathComponent := pathComponents[len(pathComponents)-1]
-	patterns := r.patterns[method]
-	for _, item := range patterns {
-		var verb string
-		patVerb := item.Verb()
-
-		idx := -1
-		if patVerb != "" && strings.HasSuffix(lastPathComponent, ":"+patVerb) {
-			idx = len(lastPathComponent) - len(patVerb) - 1
-		}
-		if idx == 0 {
-			return nil, nil, false
+	var (
+		pathParams map[string]string
+		extra      interface{}
+	)
+	ok = r.walk(root, pathComponents, 0, func(item *Pattern) bool {
+		params, matched := r.matchPattern(item, pathComponents)
+		if matched {
+			pathParams, extra = params, item.extra
 		}
+		return matched
+	})
+	return pathParams, extra, ok
+}
 
-		comps := make([]string, len(pathComponents))
-		copy(comps, pathComponents)
+func (r *httpRouter) Methods(path string) []string {
+	if r == nil {
+		return nil
+	}
+	var methods []string
+	for method := range r.trees {
+		if _, _, ok := r.Match(method, path); ok {
+			methods = append(methods, method)
+		}
+	}
+	sort.Strings(methods)
+	return methods
+}
 
-		if idx > 0 {
-			comps[len(comps)-1], verb = lastPathComponent[:idx], lastPathComponent[idx+1:]
+// walk visits the candidate patterns for comps[i:] below n, literal segments before wildcards
+// before "**", until try accepts one.
+func (r *httpRouter) walk(n *node, comps []string, i int, try func(*Pattern) bool) bool {
+	if i == len(comps) {
+		for _, item := range n.leaves {
+			if try(item) {
+				return true
+			}
 		}
-		pathParams, err := item.MatchAndEscape(comps, verb, r.unescapeMode)
-		if err != nil {
-			continue
+	} else {
+		comp := comps[i]
+		if child, ok := n.literals[comp]; ok && r.walk(child, comps, i+1, try) {
+			return true
+		}
+		// the last segment may carry a verb, "books:batchGet" is the literal "books"
+		if i == len(comps)-1 {
+			if idx := strings.LastIndex(comp, ":"); idx > 0 {
+				if child, ok := n.literals[comp[:idx]]; ok && r.walk(child, comps, i+1, try) {
+					return true
+				}
+			}
 		}
-		return pathParams, item.extra, true
+		if n.wildcard != nil && r.walk(n.wildcard, comps, i+1, try) {
+			return true
+		}
+	}
+	for _, item := range n.deep {
+		if try(item) {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *httpRouter) matchPattern(item *Pattern, pathComponents []string) (map[string]string, bool) {
+	var verb string
+	patVerb := item.Verb()
+	lastPathComponent := pathComponents[len(pathComponents)-1]
+
+	idx := -1
+	if patVerb != "" && strings.HasSuffix(lastPathComponent, ":"+patVerb) {
+		idx = len(lastPathComponent) - len(patVerb) - 1
+	}
+	if idx == 0 {
+		return nil, false
+	}
+
+	comps := pathComponents
+	if idx > 0 {
+		comps = make([]string, len(pathComponents))
+		copy(comps, pathComponents)
+		comps[len(comps)-1], verb = lastPathComponent[:idx], lastPathComponent[idx+1:]
+	}
+	pathParams, err := item.MatchAndEscape(comps, verb, r.unescapeMode)
+	if err != nil {
+		return nil, false
 	}
-	return nil, nil, false
+	return pathParams, true
 }
@@ -0,0 +1,300 @@
+package dynamic_proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/grpc-ecosystem/grpc-gateway/v2/runtime"
+	"github.com/jhump/protoreflect/desc"
+	"github.com/lemon-1997/dynamic-proxy/httprule"
+)
+
+// linearRouter is the router the trie replaced, it tries every pattern of the method in the
+// order they were added. It is kept as the reference for the tests and benchmarks.
+type linearRouter struct {
+	unescapeMode runtime.UnescapingMode
+	patterns     map[string][]Pattern
+}
+
+func newLinearRouter() *linearRouter {
+	return &linearRouter{
+		unescapeMode: runtime.UnescapingModeDefault,
+		patterns:     make(map[string][]Pattern),
+	}
+}
+
+func (r *linearRouter) Add(method, path string, extra interface{}) error {
+	c, err := httprule.Parse(path)
+	if err != nil {
+		return err
+	}
+	tmpl := c.Compile()
+	p, err := runtime.NewPattern(tmpl.Version, tmpl.OpCodes, tmpl.Pool, tmpl.Verb)
+	if err != nil {
+		return err
+	}
+	r.patterns[method] = append(r.patterns[method], Pattern{
+		Pattern: p,
+		extra:   extra,
+	})
+	return nil
+}
+
+func (r *linearRouter) Match(method, path string) (map[string]string, interface{}, bool) {
+	if !strings.HasPrefix(path, "/") {
+		return nil, nil, false
+	}
+	pathComponents := strings.Split(path[1:], "/")
+	lastPathComponent := pathComponents[len(pathComponents)-1]
+	for _, item := range r.patterns[method] {
+		var verb string
+		patVerb := item.Verb()
+
+		idx := -1
+		if patVerb != "" && strings.HasSuffix(lastPathComponent, ":"+patVerb) {
+			idx = len(lastPathComponent) - len(patVerb) - 1
+		}
+		if idx == 0 {
+			return nil, nil, false
+		}
+
+		comps := make([]string, len(pathComponents))
+		copy(comps, pathComponents)
+
+		if idx > 0 {
+			comps[len(comps)-1], verb = lastPathComponent[:idx], lastPathComponent[idx+1:]
+		}
+		pathParams, err := item.MatchAndEscape(comps, verb, r.unescapeMode)
+		if err != nil {
+			continue
+		}
+		return pathParams, item.extra, true
+	}
+	return nil, nil, false
+}
+
+type testRoute struct {
+	method, path string
+}
+
+// testRoutes returns 6 routes for each of n services. Within a service the more specific routes
+// come first, so the first match of the linear scan is the one the trie picks too.
+func testRoutes(n int) []testRoute {
+	var routes []testRoute
+	for i := 0; i < n; i++ {
+		prefix := fmt.Sprintf("/v1/svc%d", i)
+		routes = append(routes,
+			testRoute{"GET", prefix + "/books/{id}:archive"},
+			testRoute{"GET", prefix + "/books/{id}"},
+			testRoute{"GET", prefix + "/books"},
+			testRoute{"POST", prefix + "/books"},
+			testRoute{"GET", prefix + "/files/{path=**}"},
+			testRoute{"GET", prefix + "/shelves/{shelf}/books/{book}"},
+		)
+	}
+	return routes
+}
+
+func testPaths(services ...int) []testRoute {
+	var paths []testRoute
+	for _, i := range services {
+		prefix := fmt.Sprintf("/v1/svc%d", i)
+		paths = append(paths,
+			testRoute{"GET", prefix + "/books/42"},
+			testRoute{"GET", prefix + "/books/42:archive"},
+			testRoute{"GET", prefix + "/books"},
+			testRoute{"POST", prefix + "/books"},
+			testRoute{"GET", prefix + "/files/a/b/c.txt"},
+			testRoute{"GET", prefix + "/shelves/1/books/2"},
+			testRoute{"GET", prefix + "/missing"},
+			testRoute{"DELETE", prefix + "/books/42"},
+		)
+	}
+	return append(paths, testRoute{"GET", "/v2/books/1"}, testRoute{"GET", "/"})
+}
+
+func buildRouter[R interface {
+	Add(method, path string, extra interface{}) error
+}](tb testing.TB, router R, routes []testRoute) R {
+	tb.Helper()
+	for _, r := range routes {
+		if err := router.Add(r.method, r.path, r.method+" "+r.path); err != nil {
+			tb.Fatal(err)
+		}
+	}
+	return router
+}
+
+func TestRouterMatchesLinearScan(t *testing.T) {
+	routes := testRoutes(100)
+	trie := buildRouter(t, NewRouter(), routes)
+	linear := buildRouter(t, newLinearRouter(), routes)
+	for _, p := range testPaths(0, 1, 50, 99, 100) {
+		params, extra, ok := trie.Match(p.method, p.path)
+		wantParams, wantExtra, wantOk := linear.Match(p.method, p.path)
+		if ok != wantOk || extra != wantExtra || !reflect.DeepEqual(params, wantParams) {
+			t.Errorf("%s %s: got %v %v %v, want %v %v %v", p.method, p.path,
+				extra, params, ok, wantExtra, wantParams, wantOk)
+		}
+	}
+}
+
+func BenchmarkRouterMatch(b *testing.B) {
+	routes := testRoutes(500)
+	paths := testPaths(0, 250, 499)
+	trie := buildRouter(b, NewRouter(), routes)
+	linear := buildRouter(b, newLinearRouter(), routes)
+	routers := []struct {
+		name  string
+		match func(method, path string) (map[string]string, interface{}, bool)
+	}{
+		{"trie", trie.Match},
+		{"linear", linear.Match},
+	}
+	for _, r := range routers {
+		b.Run(fmt.Sprintf("%s/%d routes", r.name, len(routes)), func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				p := paths[i%len(paths)]
+				r.match(p.method, p.path)
+			}
+		})
+	}
+}
+
+func TestRouterPrecedence(t *testing.T) {
+	tests := []struct {
+		name   string
+		routes []string
+		path   string
+		want   string
+		params map[string]string
+	}{
+		{name: "literal over variable", routes: []string{"/v1/{name}", "/v1/books"}, path: "/v1/books", want: "/v1/books"},
+		{name: "variable when no literal", routes: []string{"/v1/{name}", "/v1/books"}, path: "/v1/shelves", want: "/v1/{name}", params: map[string]string{"name": "shelves"}},
+		{name: "literal over deep", routes: []string{"/v1/{path=**}", "/v1/books/{id}"}, path: "/v1/books/1", want: "/v1/books/{id}", params: map[string]string{"id": "1"}},
+		{name: "deep when no other", routes: []string{"/v1/{path=**}", "/v1/books/{id}"}, path: "/v1/books/1/pages", want: "/v1/{path=**}", params: map[string]string{"path": "books/1/pages"}},
+		{name: "verb over no verb", routes: []string{"/v1/books/{id}", "/v1/books/{id}:archive"}, path: "/v1/books/1:archive", want: "/v1/books/{id}:archive", params: map[string]string{"id": "1"}},
+		{name: "no verb without verb", routes: []string{"/v1/books/{id}", "/v1/books/{id}:archive"}, path: "/v1/books/1", want: "/v1/books/{id}", params: map[string]string{"id": "1"}},
+		{name: "longer deep tail", routes: []string{"/v1/{path=**}", "/v1/{path=**}/meta"}, path: "/v1/a/b/meta", want: "/v1/{path=**}/meta", params: map[string]string{"path": "a/b"}},
+	}
+	for _, tt := range tests {
+		// the winner must not depend on the order the routes were added in
+		for _, reverse := range []bool{false, true} {
+			t.Run(fmt.Sprintf("%s/reverse=%v", tt.name, reverse), func(t *testing.T) {
+				router := NewRouter()
+				for i := range tt.routes {
+					route := tt.routes[i]
+					if reverse {
+						route = tt.routes[len(tt.routes)-1-i]
+					}
+					if err := router.Add("GET", route, route); err != nil {
+						t.Fatal(err)
+					}
+				}
+				params, extra, ok := router.Match("GET", tt.path)
+				if !ok || extra != tt.want {
+					t.Fatalf("match %s: got %v %v, want %s", tt.path, extra, ok, tt.want)
+				}
+				if len(params) > 0 || len(tt.params) > 0 {
+					if !reflect.DeepEqual(params, tt.params) {
+						t.Errorf("params of %s: got %v, want %v", tt.path, params, tt.params)
+					}
+				}
+			})
+		}
+	}
+}
+
+func TestRouterConflict(t *testing.T) {
+	tests := []struct {
+		name     string
+		first    testRoute
+		second   testRoute
+		conflict bool
+	}{
+		{name: "variable names", first: testRoute{"GET", "/v1/{name}"}, second: testRoute{"GET", "/v1/{id}"}, conflict: true},
+		{name: "nested variable names", first: testRoute{"GET", "/v1/shelves/{shelf}/books/{id}"}, second: testRoute{"GET", "/v1/shelves/{s}/books/{b}"}, conflict: true},
+		{name: "deep variable names", first: testRoute{"GET", "/v1/{path=**}"}, second: testRoute{"GET", "/v1/{name=**}"}, conflict: true},
+		{name: "same template", first: testRoute{"POST", "/v1/books"}, second: testRoute{"POST", "/v1/books"}, conflict: true},
+		{name: "other method", first: testRoute{"GET", "/v1/{name}"}, second: testRoute{"DELETE", "/v1/{id}"}},
+		{name: "other verb", first: testRoute{"GET", "/v1/{name}"}, second: testRoute{"GET", "/v1/{id}:watch"}},
+		{name: "literal and variable", first: testRoute{"GET", "/v1/{name}"}, second: testRoute{"GET", "/v1/books"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			router := NewRouter()
+			if err := router.Add(tt.first.method, tt.first.path, "first"); err != nil {
+				t.Fatal(err)
+			}
+			err := router.Add(tt.second.method, tt.second.path, "second")
+			var conflict *ConflictError
+			if errors.As(err, &conflict) != tt.conflict {
+				t.Fatalf("add %s after %s: got %v, want conflict %v", tt.second.path, tt.first.path, err, tt.conflict)
+			}
+			if !tt.conflict {
+				if err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			if conflict.Extra != "first" || conflict.Method != tt.second.method || conflict.Path != tt.second.path {
+				t.Errorf("conflict: got %+v", conflict)
+			}
+			// the route added first keeps serving
+			path := strings.NewReplacer("{name}", "x", "{id}", "x", "{shelf}", "x", "{path=**}", "x").Replace(tt.first.path)
+			if _, extra, ok := router.Match(tt.first.method, path); !ok || extra != "first" {
+				t.Errorf("match %s: got %v %v, want first", path, extra, ok)
+			}
+		})
+	}
+}
+
+const findBookRPC = `  rpc FindBook(Book) returns (Book) {
+    option (google.api.http) = {get: "/v1/books/{id}"};
+  }`
+
+func TestStrictRoutes(t *testing.T) {
+	for _, strict := range []bool{false, true} {
+		t.Run(fmt.Sprintf("strict=%v", strict), func(t *testing.T) {
+			src := &flipSource{versions: []map[string]*desc.ServiceDescriptor{
+				compileServices(t, fmt.Sprintf(libraryProto, findBookRPC)),
+			}}
+			c := &ReflectClient{
+				log:    slog.New(slog.NewTextHandler(io.Discard, nil)),
+				opts:   clientOptions{reflectTimeout: time.Second, reflectAttempts: 3, reflectBackoff: time.Second, strictRoutes: strict},
+				target: "library",
+				source: src,
+			}
+			table, err := c.resolve(context.Background())
+			if !strict {
+				if err != nil {
+					t.Fatal(err)
+				}
+				// the method declared first keeps the route
+				if b, _ := table.MethodBinding("GET", "/v1/books/1"); b == nil || b.Method.GetName() != "GetBook" {
+					t.Errorf("match /v1/books/1: got %v", b)
+				}
+				if len(table.conflicts) != 1 {
+					t.Errorf("got %d conflicts, want 1", len(table.conflicts))
+				}
+				return
+			}
+			var conflict *ConflictError
+			if !errors.As(err, &conflict) {
+				t.Fatalf("resolve: got %v, want a route conflict", err)
+			}
+			// a conflict does not go away by listing again
+			if n := src.n.Load(); n != 1 {
+				t.Errorf("listed services %d times, want 1", n)
+			}
+		})
+	}
+}
@@ -0,0 +1,360 @@
+package dynamic_proxy
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/bufbuild/protocompile"
+	"github.com/jhump/protoreflect/desc"
+	"github.com/jhump/protoreflect/grpcreflect"
+	"google.golang.org/grpc"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+	"google.golang.org/protobuf/types/descriptorpb"
+)
+
+// DescriptorSource resolves the services exposed by a target.
+type DescriptorSource interface {
+	ListServices(ctx context.Context) ([]string, error)
+	ResolveService(ctx context.Context, name string) (*desc.ServiceDescriptor, error)
+}
+
+// WatchableSource is a DescriptorSource whose descriptors can change on their own, like files on disk.
+type WatchableSource interface {
+	DescriptorSource
+	// Watch checks for changes every interval until ctx is done and reloads the descriptors,
+	// onChange is called with the reload error. The last good descriptors are kept on failure.
+	Watch(ctx context.Context, interval time.Duration, onChange func(err error))
+}
+
+// DescriptorSourceFunc creates the descriptor source of a target once its connection is dialed,
+// calls made through conn carry the reflection call options of the client.
+type DescriptorSourceFunc func(target string, conn grpc.ClientConnInterface) (DescriptorSource, error)
+
+// ReflectionSource is the default DescriptorSourceFunc, it asks the target itself through gRPC reflection.
+func ReflectionSource(_ string, conn grpc.ClientConnInterface) (DescriptorSource, error) {
+	return NewReflectionSource(conn), nil
+}
+
+// ProtosetSource serves every target from the same FileDescriptorSet files.
+func ProtosetSource(paths ...string) DescriptorSourceFunc {
+	return func(string, grpc.ClientConnInterface) (DescriptorSource, error) {
+		return NewProtosetSource(paths...)
+	}
+}
+
+// ProtoSource serves every target from the .proto files compiled out of dir.
+func ProtoSource(dir string) DescriptorSourceFunc {
+	return func(string, grpc.ClientConnInterface) (DescriptorSource, error) {
+		return NewProtoSource(dir)
+	}
+}
+
+type reflectionSource struct {
+	conn   grpc.ClientConnInterface
+	client *grpcreflect.Client
+}
+
+func NewReflectionSource(conn grpc.ClientConnInterface) DescriptorSource {
+	return &reflectionSource{conn: conn}
+}
+
+// ListServices starts a new reflection session, so descriptors updated on the server
+// are not served from the cache of the previous one.
+func (s *reflectionSource) ListServices(ctx context.Context) ([]string, error) {
+	if s.client != nil {
+		s.client.Reset()
+	}
+	s.client = grpcreflect.NewClientAuto(ctx, s.conn)
+	return s.client.ListServices()
+}
+
+func (s *reflectionSource) ResolveService(ctx context.Context, name string) (*desc.ServiceDescriptor, error) {
+	if s.client == nil {
+		s.client = grpcreflect.NewClientAuto(ctx, s.conn)
+	}
+	return s.client.ResolveService(name)
+}
+
+// callOptionConn adds opts to every call made through the connection.
+type callOptionConn struct {
+	grpc.ClientConnInterface
+	opts []grpc.CallOption
+}
+
+func (c *callOptionConn) Invoke(ctx context.Context, method string, args any, reply any, opts ...grpc.CallOption) error {
+	return c.ClientConnInterface.Invoke(ctx, method, args, reply, append(c.opts[:len(c.opts):len(c.opts)], opts...)...)
+}
+
+func (c *callOptionConn) NewStream(ctx context.Context, desc *grpc.StreamDesc, method string, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+	return c.ClientConnInterface.NewStream(ctx, desc, method, append(c.opts[:len(c.opts):len(c.opts)], opts...)...)
+}
+
+type fileSource struct {
+	paths    []string
+	ext      string
+	load     func(files []string) (*descriptorpb.FileDescriptorSet, error)
+	mu       sync.RWMutex
+	sum      string
+	services map[string]*desc.ServiceDescriptor
+}
+
+// NewProtosetSource loads descriptors from FileDescriptorSet files, as produced by
+// `protoc --include_imports --descriptor_set_out`. Directories are searched for *.protoset files.
+func NewProtosetSource(paths ...string) (DescriptorSource, error) {
+	s := &fileSource{
+		paths: paths,
+		ext:   ".protoset",
+		load:  readProtosets,
+	}
+	if err := s.reload(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func readProtosets(files []string) (*descriptorpb.FileDescriptorSet, error) {
+	set := &descriptorpb.FileDescriptorSet{}
+	seen := make(map[string]bool)
+	for _, file := range files {
+		b, err := os.ReadFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read protoset: %v", err)
+		}
+		var fds descriptorpb.FileDescriptorSet
+		if err = proto.Unmarshal(b, &fds); err != nil {
+			return nil, fmt.Errorf("failed to parse protoset %s: %v", file, err)
+		}
+		for _, fd := range fds.GetFile() {
+			if seen[fd.GetName()] {
+				continue
+			}
+			seen[fd.GetName()] = true
+			set.File = append(set.File, fd)
+		}
+	}
+	return set, nil
+}
+
+func servicesFromSet(set *descriptorpb.FileDescriptorSet) (map[string]*desc.ServiceDescriptor, error) {
+	files, err := desc.CreateFileDescriptorsFromSet(set)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create file descriptors: %v", err)
+	}
+	services := make(map[string]*desc.ServiceDescriptor)
+	for _, fd := range files {
+		for _, sd := range fd.GetServices() {
+			services[sd.GetFullyQualifiedName()] = sd
+		}
+	}
+	return services, nil
+}
+
+// NewProtoSource compiles every .proto file under dir in-process. Imports are resolved
+// from dir first, then from the standard imports and the files linked into the binary,
+// so google/api/annotations.proto does not have to be vendored.
+func NewProtoSource(dir string) (DescriptorSource, error) {
+	s := &fileSource{
+		paths: []string{dir},
+		ext:   ".proto",
+		load: func(files []string) (*descriptorpb.FileDescriptorSet, error) {
+			return compileProtos(dir, files)
+		},
+	}
+	if err := s.reload(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func compileProtos(dir string, files []string) (*descriptorpb.FileDescriptorSet, error) {
+	names := make([]string, 0, len(files))
+	for _, file := range files {
+		rel, err := filepath.Rel(dir, file)
+		if err != nil {
+			return nil, fmt.Errorf("failed to resolve proto path: %v", err)
+		}
+		names = append(names, filepath.ToSlash(rel))
+	}
+	compiler := protocompile.Compiler{
+		Resolver: protocompile.WithStandardImports(protocompile.CompositeResolver{
+			&protocompile.SourceResolver{ImportPaths: []string{dir}},
+			protocompile.ResolverFunc(func(path string) (protocompile.SearchResult, error) {
+				fd, err := protoregistry.GlobalFiles.FindFileByPath(path)
+				if err != nil {
+					return protocompile.SearchResult{}, err
+				}
+				return protocompile.SearchResult{Desc: fd}, nil
+			}),
+		}),
+	}
+	compiled, err := compiler.Compile(context.Background(), names...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to compile protos: %v", err)
+	}
+	fds := make([]protoreflect.FileDescriptor, 0, len(compiled))
+	for _, f := range compiled {
+		fds = append(fds, f)
+	}
+	// round trip through the wire format, so options such as google.api.http are
+	// parsed with the extension types linked into the binary, like reflection does
+	b, err := proto.Marshal(toFileDescriptorSet(fds))
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal compiled protos: %v", err)
+	}
+	var set descriptorpb.FileDescriptorSet
+	if err = proto.Unmarshal(b, &set); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal compiled protos: %v", err)
+	}
+	return &set, nil
+}
+
+// toFileDescriptorSet collects files and all their imports, dependencies first.
+func toFileDescriptorSet(files []protoreflect.FileDescriptor) *descriptorpb.FileDescriptorSet {
+	set := &descriptorpb.FileDescriptorSet{}
+	seen := make(map[string]bool)
+	var add func(fd protoreflect.FileDescriptor)
+	add = func(fd protoreflect.FileDescriptor) {
+		if seen[fd.Path()] {
+			return
+		}
+		seen[fd.Path()] = true
+		imports := fd.Imports()
+		for i := 0; i < imports.Len(); i++ {
+			add(imports.Get(i).FileDescriptor)
+		}
+		set.File = append(set.File, protodesc.ToFileDescriptorProto(fd))
+	}
+	for _, fd := range files {
+		add(fd)
+	}
+	return set
+}
+
+// listFiles expands directories in paths to the files with extension ext below them, sorted.
+func listFiles(paths []string, ext string) ([]string, error) {
+	var files []string
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, err
+		}
+		if !info.IsDir() {
+			files = append(files, path)
+			continue
+		}
+		err = filepath.WalkDir(path, func(file string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if !d.IsDir() && filepath.Ext(file) == ext {
+				files = append(files, file)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+// fingerprint changes whenever one of the files is added, removed or modified.
+func fingerprint(files []string) (string, error) {
+	h := sha256.New()
+	for _, file := range files {
+		info, err := os.Stat(file)
+		if err != nil {
+			return "", err
+		}
+		fmt.Fprintf(h, "%s %d %d\n", file, info.Size(), info.ModTime().UnixNano())
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func (s *fileSource) reload() error {
+	files, err := listFiles(s.paths, s.ext)
+	if err != nil {
+		return fmt.Errorf("failed to list descriptor files: %v", err)
+	}
+	// fingerprint before loading, so a change made while loading is seen by the next check
+	sum, err := fingerprint(files)
+	if err != nil {
+		return fmt.Errorf("failed to stat descriptor files: %v", err)
+	}
+	s.mu.Lock()
+	s.sum = sum
+	s.mu.Unlock()
+	set, err := s.load(files)
+	if err != nil {
+		return err
+	}
+	services, err := servicesFromSet(set)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	s.services = services
+	s.mu.Unlock()
+	return nil
+}
+
+func (s *fileSource) changed() bool {
+	files, err := listFiles(s.paths, s.ext)
+	if err != nil {
+		// a missing directory is a change too, reload reports the error
+		files = nil
+	}
+	sum, _ := fingerprint(files)
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return sum != s.sum
+}
+
+func (s *fileSource) Watch(ctx context.Context, interval time.Duration, onChange func(err error)) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if !s.changed() {
+			continue
+		}
+		onChange(s.reload())
+	}
+}
+
+func (s *fileSource) ListServices(_ context.Context) ([]string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	names := make([]string, 0, len(s.services))
+	for name := range s.services {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+func (s *fileSource) ResolveService(_ context.Context, name string) (*desc.ServiceDescriptor, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	sd, ok := s.services[name]
+	if !ok {
+		return nil, fmt.Errorf("service %s not found", name)
+	}
+	return sd, nil
+}
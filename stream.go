@@ -0,0 +1,262 @@
+package dynamic_proxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+
+	"github.com/jhump/protoreflect/dynamic"
+	"github.com/lemon-1997/dynamic-proxy/encoding"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// StreamWriter writes the messages of a server stream to an HTTP response.
+type StreamWriter interface {
+	// Write sends one response message to the client and flushes it.
+	Write(msg *dynamic.Message) error
+	// Close finishes the stream, reporting err to the client if it is not nil.
+	Close(err error) error
+}
+
+type sseWriter struct {
+	w            http.ResponseWriter
+	f            http.Flusher
+	codec        encoding.Codec
+	responseBody string
+}
+
+type ndjsonWriter struct {
+	w            http.ResponseWriter
+	f            http.Flusher
+	codec        encoding.Codec
+	responseBody string
+}
+
+// NewStreamWriter picks the stream format from the Accept header, newline-delimited JSON
+// for application/x-ndjson and Server-Sent Events otherwise.
+func NewStreamWriter(r *http.Request, w http.ResponseWriter, responseBody string) (StreamWriter, error) {
+	f, ok := w.(http.Flusher)
+	if !ok {
+		return nil, errors.New("response writer does not support flush")
+	}
+	codec := CodecForRequest(r, "Accept")
+	if codec.Subtype() == encoding.NdjsonSubType {
+		w.Header().Set("Content-Type", "application/"+codec.Subtype())
+		w.Header().Set("Trailer", "Grpc-Status, Grpc-Message")
+		w.WriteHeader(http.StatusOK)
+		f.Flush()
+		return &ndjsonWriter{
+			w:            w,
+			f:            f,
+			codec:        codec,
+			responseBody: responseBody,
+		}, nil
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	f.Flush()
+	return &sseWriter{
+		w:            w,
+		f:            f,
+		codec:        codec,
+		responseBody: responseBody,
+	}, nil
+}
+
+func (s *sseWriter) Write(msg *dynamic.Message) error {
+	buf, err := marshalResponse(s.codec, msg, s.responseBody)
+	if err != nil {
+		return fmt.Errorf("failed to marshal output JSON: %v", err)
+	}
+	return s.event("", buf)
+}
+
+func (s *sseWriter) Close(err error) error {
+	if err == nil {
+		return nil
+	}
+	b, err := statusResponse(err)
+	if err != nil {
+		return err
+	}
+	return s.event("error", b)
+}
+
+// https://html.spec.whatwg.org/multipage/server-sent-events.html#event-stream-interpretation
+func (s *sseWriter) event(name string, data []byte) error {
+	var buf bytes.Buffer
+	if name != "" {
+		buf.WriteString("event: " + name + "\n")
+	}
+	for _, line := range bytes.Split(data, []byte("\n")) {
+		buf.WriteString("data: ")
+		buf.Write(line)
+		buf.WriteByte('\n')
+	}
+	buf.WriteByte('\n')
+	if _, err := s.w.Write(buf.Bytes()); err != nil {
+		return fmt.Errorf("failed to write response: %v", err)
+	}
+	s.f.Flush()
+	return nil
+}
+
+func (s *ndjsonWriter) Write(msg *dynamic.Message) error {
+	buf, err := marshalResponse(s.codec, msg, s.responseBody)
+	if err != nil {
+		return fmt.Errorf("failed to marshal output JSON: %v", err)
+	}
+	return s.line(buf)
+}
+
+// Close reports the final status both as the last line and as http trailers.
+func (s *ndjsonWriter) Close(err error) error {
+	grpcStatus := status.Convert(err)
+	s.w.Header().Set("Grpc-Status", strconv.Itoa(int(grpcStatus.Code())))
+	s.w.Header().Set("Grpc-Message", grpcStatus.Message())
+	b, err := statusResponse(err)
+	if err != nil {
+		return err
+	}
+	return s.line(b)
+}
+
+func (s *ndjsonWriter) line(data []byte) error {
+	if _, err := s.w.Write(append(data, '\n')); err != nil {
+		return fmt.Errorf("failed to write response: %v", err)
+	}
+	s.f.Flush()
+	return nil
+}
+
+func statusResponse(err error) ([]byte, error) {
+	grpcStatus := status.Convert(err)
+	msg := grpcStatus.Message()
+	if err == nil {
+		msg = "ok"
+	}
+	b, err := json.Marshal(Response{
+		Status: int32(grpcStatus.Code()),
+		Msg:    msg,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to write response: %v", err)
+	}
+	return b, nil
+}
+
+func (p *Proxy) serveServerStream(w http.ResponseWriter, r *http.Request, client *ReflectClient, b *Binding, params map[string]string) {
+	md := b.Method
+	// the stream lives as long as the http client is connected, the unary timeout does not apply
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+
+	msg := dynamic.NewMessage(md.GetInputType())
+	if err := RequestEncodeBody(r, msg, params, b.Body); err != nil {
+		p.opts.log.Error("request encode", "err", err)
+		p.opts.errDecoder(w, err)
+		return
+	}
+
+	ctx = metadata.NewOutgoingContext(ctx, p.metadataFromHeaders(r.Header))
+	stream, err := client.InvokeServerStream(ctx, md, msg)
+	if err != nil {
+		p.opts.log.Error("client invoke", "err", err)
+		p.opts.errDecoder(w, err)
+		return
+	}
+	header, err := stream.Header()
+	if err != nil {
+		p.opts.log.Error("client invoke", "err", err)
+		p.opts.errDecoder(w, err)
+		return
+	}
+	p.writeHeader(w, header)
+
+	sw, err := NewStreamWriter(r, w, b.ResponseBody)
+	if err != nil {
+		p.opts.log.Error("response decode", "err", err)
+		p.opts.errDecoder(w, err)
+		return
+	}
+	for {
+		res, err := stream.RecvMsg()
+		if err != nil {
+			if err == io.EOF {
+				err = nil
+			} else {
+				p.opts.log.Error("client stream", "err", err)
+			}
+			if err = sw.Close(err); err != nil {
+				p.opts.log.Error("response decode", "err", err)
+			}
+			return
+		}
+		dm, err := outputMessage(md, res)
+		if err != nil {
+			p.opts.log.Error("client stream", "err", err)
+			sw.Close(err)
+			return
+		}
+		if err = sw.Write(dm); err != nil {
+			// the http client is most likely gone, returning cancels the grpc stream
+			p.opts.log.Error("response decode", "err", err)
+			return
+		}
+	}
+}
+
+func (p *Proxy) serveClientStream(w http.ResponseWriter, r *http.Request, client *ReflectClient, b *Binding, params map[string]string) {
+	md := b.Method
+	// uploads may take longer than the unary timeout, the stream lives as long as the http request
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+
+	ctx = metadata.NewOutgoingContext(ctx, p.metadataFromHeaders(r.Header))
+	stream, err := client.InvokeClientStream(ctx, md)
+	if err != nil {
+		p.opts.log.Error("client invoke", "err", err)
+		p.opts.errDecoder(w, err)
+		return
+	}
+
+	err = StreamBodyEncode(r, md.GetInputType(), params, func(msg *dynamic.Message) error {
+		return stream.SendMsg(msg)
+	})
+	// io.EOF means the server ended the stream early, its status is returned by CloseAndReceive
+	if err != nil && err != io.EOF {
+		p.opts.log.Error("request encode", "err", err)
+		p.opts.errDecoder(w, err)
+		return
+	}
+
+	res, err := stream.CloseAndReceive()
+	if err != nil {
+		p.opts.log.Error("client invoke", "err", err)
+		p.opts.errDecoder(w, err)
+		return
+	}
+	resp, err := outputMessage(md, res)
+	if err != nil {
+		p.opts.log.Error("client invoke", "err", err)
+		p.opts.errDecoder(w, err)
+		return
+	}
+	header, err := stream.Header()
+	if err == nil {
+		p.writeHeader(w, header)
+	}
+
+	if err = ResponseDecodeField(r, w, resp, b.ResponseBody); err != nil {
+		p.opts.log.Error("response decode", "err", err)
+		p.opts.errDecoder(w, err)
+		return
+	}
+}
@@ -0,0 +1,123 @@
+package dynamic_proxy
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"sort"
+
+	"github.com/jhump/protoreflect/desc"
+	"google.golang.org/protobuf/proto"
+)
+
+// routeTable is the router built from one listing of a target's services.
+type routeTable struct {
+	router Router
+	// sum identifies the descriptors the table was built from
+	sum string
+	// methods holds the fully qualified name of every method
+	methods map[string]bool
+	// routes maps "VERB /path/template" to the method bound to it
+	routes map[string]string
+	// files are the descriptors the services were resolved from
+	files []*desc.FileDescriptor
+	// cached is set when the table was loaded from the descriptor cache
+	cached bool
+	// services lists every service of the target, sorted
+	services []string
+	// failed holds the services that could not be resolved, they have no routes
+	failed map[string]error
+	// conflicts holds the routes left out because an earlier route matches the same requests
+	conflicts []error
+	// bindings holds every route added to router, in order
+	bindings []routeBinding
+}
+
+type routeBinding struct {
+	verb    string
+	path    string
+	binding *Binding
+}
+
+func newRouteTable() *routeTable {
+	return &routeTable{
+		router:  NewRouter(),
+		methods: make(map[string]bool),
+		routes:  make(map[string]string),
+		failed:  make(map[string]error),
+	}
+}
+
+// routeMatcher finds the binding of a request, in the routes of one target or of all of them.
+type routeMatcher interface {
+	MethodBinding(method, path string) (*Binding, map[string]string)
+	AllowedMethods(path string) []string
+}
+
+func (t *routeTable) MethodBinding(method, path string) (*Binding, map[string]string) {
+	if t == nil {
+		return nil, nil
+	}
+	params, extra, ok := t.router.Match(method, path)
+	if !ok {
+		return nil, nil
+	}
+	if b, ok := extra.(*Binding); ok {
+		return b, params
+	}
+	return nil, nil
+}
+
+func (t *routeTable) AllowedMethods(path string) []string {
+	if t == nil {
+		return nil
+	}
+	return t.router.Methods(path)
+}
+
+func (t *routeTable) routeBindings() []routeBinding {
+	if t == nil {
+		return nil
+	}
+	return t.bindings
+}
+
+// ServiceStatus is the state of one service of a target.
+type ServiceStatus struct {
+	Name string
+	// Err is why the service could not be resolved, nil when its routes are registered.
+	Err error
+}
+
+// descriptorSum hashes files and their dependencies.
+func descriptorSum(files []*desc.FileDescriptor) (string, error) {
+	set := desc.ToFileDescriptorSet(files...)
+	b, err := proto.MarshalOptions{Deterministic: true}.Marshal(set)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal descriptors: %v", err)
+	}
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// diffKeys returns the sorted keys only in next and the sorted keys only in prev.
+func diffKeys[V any](prev, next map[string]V) (added, removed []string) {
+	for k := range next {
+		if _, ok := prev[k]; !ok {
+			added = append(added, k)
+		}
+	}
+	for k := range prev {
+		if _, ok := next[k]; !ok {
+			removed = append(removed, k)
+		}
+	}
+	sort.Strings(added)
+	sort.Strings(removed)
+	return added, removed
+}
+
+func sameKeys[V any](a, b map[string]V) bool {
+	added, removed := diffKeys(a, b)
+	return len(added) == 0 && len(removed) == 0
+}
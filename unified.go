@@ -0,0 +1,92 @@
+package dynamic_proxy
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// WithTargets serves the routes of all targets from one router, so request paths carry no target
+// and the path extractor is not used. When routes of two targets conflict, the target listed
+// first wins and the conflict is logged.
+func WithTargets(targets ...string) ProxyOption {
+	return func(o *proxyOptions) {
+		o.targets = targets
+	}
+}
+
+// dialTargets connects every target in the background, retrying with backoff until it succeeds
+// or the proxy is closed.
+func (p *Proxy) dialTargets() {
+	for _, target := range p.opts.targets {
+		go func(target string) {
+			backoff := retryMinBackoff
+			for {
+				ctx, cancel := context.WithTimeout(p.ctx, p.opts.timeout)
+				_, err := p.Client(ctx, target)
+				cancel()
+				if err == nil {
+					p.rebuildUnified()
+					return
+				}
+				if errors.Is(err, ErrTargetDenied) {
+					p.opts.log.Error("target denied", "target", target, "err", err)
+					return
+				}
+				if p.ctx.Err() != nil {
+					return
+				}
+				p.opts.log.Error("connect target fail", "target", target, "backoff", backoff, "err", err)
+				select {
+				case <-p.ctx.Done():
+					return
+				case <-time.After(backoff):
+				}
+				backoff = min(backoff*2, retryMaxBackoff)
+			}
+		}(target)
+	}
+}
+
+// rebuildUnified merges the current routes of every connected target into a new router.
+func (p *Proxy) rebuildUnified() {
+	p.unifiedMu.Lock()
+	defer p.unifiedMu.Unlock()
+	table := newRouteTable()
+	for _, target := range p.opts.targets {
+		v, ok := p.srv.Load(target)
+		if !ok {
+			continue
+		}
+		for _, rb := range v.(*clientEntry).client.table.Load().routeBindings() {
+			err := table.router.Add(rb.verb, rb.path, rb.binding)
+			var conflict *ConflictError
+			if errors.As(err, &conflict) {
+				// conflicts within one target never get here, the client left them out
+				existing := ""
+				if b, ok := conflict.Extra.(*Binding); ok {
+					existing = b.client.target
+				}
+				p.opts.log.Warn("route conflict across targets", "target", target,
+					"method", rb.binding.Method.GetFullyQualifiedName(), "existing_target", existing, "err", err)
+				table.conflicts = append(table.conflicts, err)
+				continue
+			}
+			if err != nil {
+				p.opts.log.Error("build route fail", "target", target, "err", err)
+				continue
+			}
+			table.bindings = append(table.bindings, rb)
+			table.routes[rb.verb+" "+rb.path] = target
+		}
+	}
+	old := p.unified.Load()
+	p.unified.Store(table)
+	if old == nil {
+		old = newRouteTable()
+	}
+	added, removed := diffKeys(old.routes, table.routes)
+	if len(added) > 0 || len(removed) > 0 {
+		p.opts.log.Info("update unified routes", "routes_added", added, "routes_removed", removed)
+	}
+}
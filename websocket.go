@@ -0,0 +1,161 @@
+package dynamic_proxy
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gorilla/websocket"
+	"github.com/jhump/protoreflect/dynamic"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// https://www.rfc-editor.org/rfc/rfc6455#section-5.5
+const maxCloseReason = 123
+
+const closeTimeout = time.Second
+
+func (p *Proxy) serveBidiStream(w http.ResponseWriter, r *http.Request, client *ReflectClient, b *Binding, params map[string]string) {
+	md := b.Method
+	if !websocket.IsWebSocketUpgrade(r) {
+		p.opts.log.Warn("websocket upgrade required", "path", r.URL.Path)
+		w.Header().Set("Upgrade", "websocket")
+		w.WriteHeader(http.StatusUpgradeRequired)
+		return
+	}
+
+	// path and query params seed the first message, as they do for unary calls
+	seed := dynamic.NewMessage(md.GetInputType())
+	if err := RequestEncodeBody(r, seed, params, b.Body); err != nil {
+		p.opts.log.Error("request encode", "err", err)
+		p.opts.errDecoder(w, err)
+		return
+	}
+	reqCodec := CodecForRequest(r, "Content-Type")
+	respCodec := CodecForRequest(r, "Accept")
+
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+	ctx = metadata.NewOutgoingContext(ctx, p.metadataFromHeaders(r.Header))
+	stream, err := client.InvokeBidiStream(ctx, md)
+	if err != nil {
+		p.opts.log.Error("client invoke", "err", err)
+		p.opts.errDecoder(w, err)
+		return
+	}
+
+	conn, err := p.opts.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// the upgrader has already replied with an http error
+		p.opts.log.Error("websocket upgrade", "err", err)
+		return
+	}
+	defer conn.Close()
+	// a close frame from the client only half-closes the stream, the close reply carries the grpc status
+	conn.SetCloseHandler(func(int, string) error {
+		return nil
+	})
+
+	go func() {
+		msg := seed
+		for {
+			_, data, err := conn.ReadMessage()
+			if err != nil {
+				if websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+					stream.CloseSend()
+					return
+				}
+				p.opts.log.Warn("websocket read", "err", err)
+				cancel()
+				return
+			}
+			frame := dynamic.NewMessage(md.GetInputType())
+			if err = reqCodec.Unmarshal(data, nil, frame); err != nil {
+				p.opts.log.Error("request encode", "err", err)
+				writeClose(conn, websocket.CloseInvalidFramePayloadData, err.Error())
+				cancel()
+				return
+			}
+			if msg == nil {
+				msg = frame
+			} else if err = msg.MergeFrom(frame); err != nil {
+				p.opts.log.Error("request encode", "err", err)
+				writeClose(conn, websocket.CloseInvalidFramePayloadData, err.Error())
+				cancel()
+				return
+			}
+			if err = stream.SendMsg(msg); err != nil {
+				// the server ended the stream, its status is reported by RecvMsg
+				return
+			}
+			msg = nil
+		}
+	}()
+
+	for {
+		res, err := stream.RecvMsg()
+		if err != nil {
+			if err != io.EOF {
+				p.opts.log.Error("client stream", "err", err)
+			}
+			code, reason := closeCodeFromError(err)
+			writeClose(conn, code, reason)
+			return
+		}
+		dm, err := outputMessage(md, res)
+		if err != nil {
+			p.opts.log.Error("client stream", "err", err)
+			writeClose(conn, websocket.CloseInternalServerErr, err.Error())
+			return
+		}
+		buf, err := marshalResponse(respCodec, dm, b.ResponseBody)
+		if err != nil {
+			p.opts.log.Error("response decode", "err", err)
+			writeClose(conn, websocket.CloseInternalServerErr, err.Error())
+			return
+		}
+		if err = conn.WriteMessage(websocket.TextMessage, buf); err != nil {
+			p.opts.log.Error("response decode", "err", err)
+			return
+		}
+	}
+}
+
+func writeClose(conn *websocket.Conn, code int, reason string) {
+	if len(reason) > maxCloseReason {
+		// the reason has to stay valid utf-8, cut before the rune split by the limit
+		n := maxCloseReason
+		for n > 0 && !utf8.RuneStart(reason[n]) {
+			n--
+		}
+		reason = reason[:n]
+	}
+	conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, reason), time.Now().Add(closeTimeout))
+}
+
+func closeCodeFromError(err error) (int, string) {
+	if err == io.EOF {
+		return websocket.CloseNormalClosure, ""
+	}
+	grpcStatus := status.Convert(err)
+	switch grpcStatus.Code() {
+	case codes.OK:
+		return websocket.CloseNormalClosure, ""
+	case codes.Canceled:
+		return websocket.CloseGoingAway, grpcStatus.Message()
+	case codes.InvalidArgument, codes.FailedPrecondition, codes.OutOfRange:
+		return websocket.CloseInvalidFramePayloadData, grpcStatus.Message()
+	case codes.PermissionDenied, codes.Unauthenticated:
+		return websocket.ClosePolicyViolation, grpcStatus.Message()
+	case codes.Unimplemented:
+		return websocket.CloseUnsupportedData, grpcStatus.Message()
+	case codes.ResourceExhausted, codes.Unavailable, codes.DeadlineExceeded:
+		return websocket.CloseTryAgainLater, grpcStatus.Message()
+	default:
+		return websocket.CloseInternalServerErr, grpcStatus.Message()
+	}
+}